@@ -2,15 +2,19 @@ module app
 
 go 1.23
 
-require github.com/stretchr/testify v1.9.0
+require (
+	github.com/georgysavva/scany/v2 v2.1.3
+	github.com/go-sql-driver/mysql v1.8.1
+	github.com/stretchr/testify v1.9.0
+	golang.org/x/crypto v0.27.0
+	golang.org/x/text v0.18.0
+)
 
 require (
 	filippo.io/edwards25519 v1.1.0 // indirect
 	github.com/DATA-DOG/go-sqlmock v1.5.2 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/georgysavva/scany/v2 v2.1.3 // indirect
-	github.com/go-sql-driver/mysql v1.8.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	golang.org/x/crypto v0.27.0 // indirect
+	golang.org/x/sys v0.25.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,98 @@
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/big"
+)
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// ParseJWKS builds a verification key set from a JSON Web Key Set document.
+// Keys of unsupported types or meant for encryption are skipped.
+func ParseJWKS(data []byte) (*KeySet, error) {
+	var doc struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("decode jwks: %w", err)
+	}
+
+	var keys []Key
+	for _, jwk := range doc.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		key, err := jwk.key()
+		if err != nil {
+			slog.Warn("skipping json web key", "kid", jwk.Kid, "err", err)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return NewKeySet(keys...), nil
+}
+
+func (jwk jsonWebKey) key() (Key, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return Key{}, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return Key{}, err
+		}
+		return NewRS256VerifyKey(jwk.Kid, &rsa.PublicKey{N: n, E: int(e.Int64())}), nil
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return Key{}, fmt.Errorf("curve %q: %w", jwk.Crv, ErrInvalidKey)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return Key{}, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return Key{}, err
+		}
+		return NewES256VerifyKey(jwk.Kid, &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}), nil
+	case "OKP":
+		if jwk.Crv != "Ed25519" {
+			return Key{}, fmt.Errorf("curve %q: %w", jwk.Crv, ErrInvalidKey)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return Key{}, fmt.Errorf("ed25519 public key: %w", ErrInvalidKey)
+		}
+		return NewEdDSAVerifyKey(jwk.Kid, ed25519.PublicKey(x)), nil
+	default:
+		return Key{}, fmt.Errorf("key type %q: %w", jwk.Kty, ErrInvalidKey)
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("decode key parameter: %w", ErrInvalidKey)
+	}
+	return new(big.Int).SetBytes(b), nil
+}
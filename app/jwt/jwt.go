@@ -0,0 +1,251 @@
+package jwt
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMalformed  = errors.New("malformed token")
+	ErrUnknownKey = errors.New("unknown signing key")
+	ErrSignature  = errors.New("invalid token signature")
+	ErrExpired    = errors.New("token expired")
+	ErrClaims     = errors.New("invalid token claims")
+)
+
+// leeway tolerates small clock differences between token issuer and verifier.
+const leeway = 30 * time.Second
+
+type header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+	Kid string `json:"kid,omitempty"`
+}
+
+// Claims holds the registered JWT claims. Tokens carrying extra claims embed
+// it in their own struct.
+type Claims struct {
+	Issuer    string   `json:"iss,omitempty"`
+	Subject   string   `json:"sub,omitempty"`
+	Audience  Audience `json:"aud,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	ID        string   `json:"jti,omitempty"`
+}
+
+// Audience is the "aud" claim, which may be a single string or an array.
+type Audience []string
+
+func (a Audience) Contains(aud string) bool {
+	for _, v := range a {
+		if v == aud {
+			return true
+		}
+	}
+	return false
+}
+
+func (a Audience) MarshalJSON() ([]byte, error) {
+	if len(a) == 1 {
+		return json.Marshal(a[0])
+	}
+	return json.Marshal([]string(a))
+}
+
+func (a *Audience) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*a = Audience{single}
+		return nil
+	}
+
+	var multi []string
+	if err := json.Unmarshal(b, &multi); err != nil {
+		return err
+	}
+	*a = multi
+	return nil
+}
+
+func (c Claims) validate(now time.Time, issuer, audience string) error {
+	if c.ExpiresAt == 0 || now.After(time.Unix(c.ExpiresAt, 0).Add(leeway)) {
+		return ErrExpired
+	}
+	if c.NotBefore != 0 && now.Add(leeway).Before(time.Unix(c.NotBefore, 0)) {
+		return fmt.Errorf("token not valid yet: %w", ErrClaims)
+	}
+	if issuer != "" && c.Issuer != issuer {
+		return fmt.Errorf("issuer %q: %w", c.Issuer, ErrClaims)
+	}
+	if audience != "" && !c.Audience.Contains(audience) {
+		return fmt.Errorf("audience %v: %w", c.Audience, ErrClaims)
+	}
+	return nil
+}
+
+// KeySet verifies tokens signed by any of its keys, selected by the "kid"
+// header.
+type KeySet struct {
+	keys map[string]Key
+}
+
+func NewKeySet(keys ...Key) *KeySet {
+	ks := &KeySet{keys: make(map[string]Key, len(keys))}
+	for _, k := range keys {
+		ks.keys[k.ID] = k
+	}
+	return ks
+}
+
+func (ks *KeySet) HasKey(kid string) bool {
+	_, ok := ks.keys[kid]
+	return ok
+}
+
+// KeyID returns the "kid" header of token without verifying it.
+func KeyID(token string) (string, error) {
+	seg, _, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", ErrMalformed
+	}
+
+	var h header
+	if err := decodeSegment(seg, &h); err != nil {
+		return "", err
+	}
+	return h.Kid, nil
+}
+
+// Verify checks the signature and registered claims of token and decodes its
+// payload into claims. Empty issuer or audience skip the respective check.
+func (ks *KeySet) Verify(token, issuer, audience string, claims any) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ErrMalformed
+	}
+
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return err
+	}
+
+	key, ok := ks.keys[h.Kid]
+	if !ok {
+		return fmt.Errorf("kid %q: %w", h.Kid, ErrUnknownKey)
+	}
+	// The algorithm is pinned by the key, never taken from the header alone.
+	if h.Alg != key.Alg {
+		return fmt.Errorf("alg %q for kid %q: %w", h.Alg, h.Kid, ErrSignature)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return ErrMalformed
+	}
+	if !key.verify([]byte(parts[0]+"."+parts[1]), sig) {
+		return ErrSignature
+	}
+
+	var registered Claims
+	if err := decodeSegment(parts[1], &registered); err != nil {
+		return err
+	}
+	if err := registered.validate(time.Now(), issuer, audience); err != nil {
+		return err
+	}
+
+	if claims == nil {
+		return nil
+	}
+	return decodeSegment(parts[1], claims)
+}
+
+// Signer issues tokens with its active key and verifies tokens signed by the
+// active key or any retired key still accepted during rotation.
+type Signer struct {
+	*KeySet
+	issuer string
+	active Key
+}
+
+func NewSigner(issuer string, active Key, retired ...Key) *Signer {
+	return &Signer{
+		KeySet: NewKeySet(append([]Key{active}, retired...)...),
+		issuer: issuer,
+		active: active,
+	}
+}
+
+// NewClaims returns registered claims for a fresh token issued by s.
+func (s *Signer) NewClaims(subject, audience string, ttl time.Duration) Claims {
+	now := time.Now()
+	return Claims{
+		Issuer:    s.issuer,
+		Subject:   subject,
+		Audience:  Audience{audience},
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+		ID:        newID(),
+	}
+}
+
+func (s *Signer) Sign(claims any) (string, error) {
+	h, err := encodeSegment(header{Alg: s.active.Alg, Typ: "JWT", Kid: s.active.ID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := encodeSegment(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := h + "." + payload
+	sig, err := s.active.sign([]byte(signingInput))
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// Verify verifies a token issued by s for the given audience.
+func (s *Signer) Verify(token, audience string, claims any) error {
+	return s.KeySet.Verify(token, s.issuer, audience, claims)
+}
+
+func encodeSegment(v any) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func decodeSegment(seg string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return ErrMalformed
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	return nil
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// IsJWT reports whether token has the three segment shape of a compact JWT,
+// which distinguishes it from opaque tokens.
+func IsJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
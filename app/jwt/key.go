@@ -0,0 +1,147 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+const (
+	HS256 = "HS256"
+	EdDSA = "EdDSA"
+	RS256 = "RS256"
+	ES256 = "ES256"
+)
+
+var ErrInvalidKey = errors.New("invalid key")
+
+// Key is a named signing or verification key. Rotation works by introducing
+// a new key ID as the active key while keeping the old one for verification
+// until every token it signed has expired.
+type Key struct {
+	ID  string
+	Alg string
+
+	secret     []byte
+	privateKey ed25519.PrivateKey
+	publicKey  crypto.PublicKey
+}
+
+func NewHS256Key(id string, secret []byte) (Key, error) {
+	if len(secret) < 32 {
+		return Key{}, fmt.Errorf("HS256 secret must be at least 32 bytes: %w", ErrInvalidKey)
+	}
+	return Key{ID: id, Alg: HS256, secret: secret}, nil
+}
+
+func NewEdDSAKey(id string, seed []byte) (Key, error) {
+	if len(seed) != ed25519.SeedSize {
+		return Key{}, fmt.Errorf("EdDSA seed must be %d bytes: %w", ed25519.SeedSize, ErrInvalidKey)
+	}
+	priv := ed25519.NewKeyFromSeed(seed)
+	return Key{ID: id, Alg: EdDSA, privateKey: priv, publicKey: priv.Public()}, nil
+}
+
+// NewRS256VerifyKey returns a key that only verifies, used for tokens
+// issued by third parties such as an OpenID provider.
+func NewRS256VerifyKey(id string, pub *rsa.PublicKey) Key {
+	return Key{ID: id, Alg: RS256, publicKey: pub}
+}
+
+func NewES256VerifyKey(id string, pub *ecdsa.PublicKey) Key {
+	return Key{ID: id, Alg: ES256, publicKey: pub}
+}
+
+func NewEdDSAVerifyKey(id string, pub ed25519.PublicKey) Key {
+	return Key{ID: id, Alg: EdDSA, publicKey: pub}
+}
+
+// ParseKey parses a key spec of the form "kid:alg:base64", where the key
+// material is the HMAC secret for HS256 or the private key seed for EdDSA.
+func ParseKey(spec string) (Key, error) {
+	id, rest, ok := strings.Cut(spec, ":")
+	if !ok {
+		return Key{}, fmt.Errorf("key spec %q: %w", id, ErrInvalidKey)
+	}
+	alg, material, ok := strings.Cut(rest, ":")
+	if !ok {
+		return Key{}, fmt.Errorf("key spec %q: %w", id, ErrInvalidKey)
+	}
+
+	b, err := base64.StdEncoding.DecodeString(material)
+	if err != nil {
+		return Key{}, fmt.Errorf("key %q material: %w", id, ErrInvalidKey)
+	}
+
+	switch alg {
+	case HS256:
+		return NewHS256Key(id, b)
+	case EdDSA:
+		return NewEdDSAKey(id, b)
+	default:
+		return Key{}, fmt.Errorf("key %q algorithm %q: %w", id, alg, ErrInvalidKey)
+	}
+}
+
+// GenerateHS256Key returns a random HS256 key. Tokens signed with it do not
+// outlive the process, so it is only suitable for development.
+func GenerateHS256Key(id string) (Key, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return Key{}, err
+	}
+	return NewHS256Key(id, secret)
+}
+
+func (k Key) sign(data []byte) ([]byte, error) {
+	switch k.Alg {
+	case HS256:
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(data)
+		return mac.Sum(nil), nil
+	case EdDSA:
+		if k.privateKey == nil {
+			return nil, fmt.Errorf("key %q is verify only: %w", k.ID, ErrInvalidKey)
+		}
+		return ed25519.Sign(k.privateKey, data), nil
+	default:
+		return nil, fmt.Errorf("sign with %q: %w", k.Alg, ErrInvalidKey)
+	}
+}
+
+func (k Key) verify(data, sig []byte) bool {
+	switch k.Alg {
+	case HS256:
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(data)
+		return hmac.Equal(sig, mac.Sum(nil))
+	case EdDSA:
+		pub, ok := k.publicKey.(ed25519.PublicKey)
+		return ok && ed25519.Verify(pub, data, sig)
+	case RS256:
+		pub, ok := k.publicKey.(*rsa.PublicKey)
+		digest := sha256.Sum256(data)
+		return ok && rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) == nil
+	case ES256:
+		pub, ok := k.publicKey.(*ecdsa.PublicKey)
+		if !ok || len(sig) != 64 {
+			return false
+		}
+		// JWS encodes ECDSA signatures as the fixed size concatenation r || s.
+		digest := sha256.Sum256(data)
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(pub, digest[:], r, s)
+	default:
+		return false
+	}
+}
@@ -1,14 +1,28 @@
 package main
 
 import (
+	"app/jwt"
+	"app/mailer"
+	"app/oidc"
+	"app/passwd"
+	"app/policy"
 	"app/post"
+	"app/server"
+	"app/session"
+	"app/throttle"
 	"app/user"
+	"app/webauthn"
 	"context"
 	"database/sql"
 	"fmt"
 	"log"
 	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -21,33 +35,136 @@ func NotImplemented(w http.ResponseWriter, r *http.Request) {
 
 func main() {
 	db := initDB()
-	userService := user.NewService(db)
-	postService := post.NewService(db)
+	sessions, refreshTokens := initSessionStores(db)
+	oidcProvider := initOIDC()
+	baseURL := envString("BASE_URL", "http://localhost:8080")
+	// The limiters count in memory, so they only hold when a single
+	// instance serves the app. Running more needs sticky routing per
+	// client or a shared store behind them.
+	accountLimiter := throttle.New(user.AccountThrottle)
+	ipLimiter := throttle.New(user.IPThrottle)
+	magicLinkLimiter := throttle.New(user.MagicLinkThrottle)
+	mailLimiter := throttle.New(user.MailThrottle)
+	authzPolicy := policy.New()
+	userService := user.NewService(db, user.Config{
+		Sessions:         sessions,
+		RefreshTokens:    refreshTokens,
+		Signer:           initSigner(),
+		AccessTokenTTL:   envDuration("ACCESS_TOKEN_TTL", 15*time.Minute),
+		OIDC:             oidcProvider,
+		WebAuthn:         initWebAuthn(baseURL),
+		CookieSecure:     os.Getenv("COOKIE_SECURE") != "false",
+		TOTPIssuer:       os.Getenv("TOTP_ISSUER"),
+		Mailer:           initMailer(),
+		BaseURL:          baseURL,
+		AccountLimiter:   accountLimiter,
+		IPLimiter:        ipLimiter,
+		MagicLinkLimiter: magicLinkLimiter,
+		MailLimiter:      mailLimiter,
+		Hasher:           initHasher(),
+		PasswordPolicy:   initPasswordPolicy(),
+		Policy:           authzPolicy,
+		DeletionMode:     initDeletionMode(),
+		RegistrationMode: initRegistrationMode(),
+	})
+	postService := post.NewService(db, post.Config{
+		Policy:               authzPolicy,
+		RequireVerifiedEmail: os.Getenv("REQUIRE_VERIFIED_EMAIL") == "true",
+	})
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("GET /", NotImplemented)
 	mux.HandleFunc("POST /register", userService.RegisterHandler())
 	mux.HandleFunc("POST /login", userService.LoginHandler())
+	mux.HandleFunc("POST /login/magic", userService.MagicLinkHandler())
+	mux.HandleFunc("GET /login/magic/{token}", userService.MagicLinkPageHandler())
+	mux.HandleFunc("POST /login/magic/{token}", userService.MagicLinkLoginHandler())
+	mux.HandleFunc("POST /login/passkey/begin", userService.BeginPasskeyLoginHandler())
+	mux.HandleFunc("POST /login/passkey/finish", userService.FinishPasskeyLoginHandler())
+	mux.HandleFunc("POST /login/2fa", userService.LoginTwoFactorHandler())
+	mux.HandleFunc("POST /token/refresh", userService.RefreshHandler())
+	mux.HandleFunc("GET /verify-email", userService.VerifyEmailPageHandler())
+	mux.HandleFunc("POST /verify-email", userService.VerifyEmailHandler())
+	mux.HandleFunc("POST /verify-email/resend", userService.TokenMiddleware(userService.ResendVerificationHandler()))
+	mux.HandleFunc("POST /password/forgot", userService.ForgotPasswordHandler())
+	mux.HandleFunc("GET /password/reset", userService.ResetPasswordPageHandler())
+	mux.HandleFunc("POST /password/reset", userService.ResetPasswordHandler())
+	if oidcProvider != nil {
+		mux.HandleFunc("GET /auth/oidc/start", userService.OIDCStartHandler())
+		mux.HandleFunc("GET /auth/oidc/callback", userService.OIDCCallbackHandler())
+	}
+	mux.HandleFunc("GET /csrf", userService.TokenMiddleware(userService.CSRFHandler()))
+	mux.HandleFunc("POST /logout", userService.TokenMiddleware(userService.LogoutHandler()))
+	mux.HandleFunc("GET /me/sessions", userService.TokenMiddleware(userService.SessionsHandler()))
+	mux.HandleFunc("DELETE /me/sessions/{id}", userService.TokenMiddleware(userService.RevokeSessionHandler()))
+	mux.HandleFunc("POST /me/sessions/revoke-all", userService.TokenMiddleware(userService.RevokeAllSessionsHandler()))
+	mux.HandleFunc("GET /me", userService.TokenMiddleware(userService.MeHandler()))
+	mux.HandleFunc("PUT /me", userService.TokenMiddleware(userService.UpdateMeHandler()))
+	mux.HandleFunc("PUT /me/password", userService.TokenMiddleware(userService.ChangePasswordHandler()))
+	mux.HandleFunc("PUT /me/email", userService.TokenMiddleware(userService.ChangeEmailHandler()))
+	mux.HandleFunc("GET /me/export", userService.TokenMiddleware(userService.ExportHandler()))
+	mux.HandleFunc("POST /me/confirmation-code", userService.TokenMiddleware(userService.ConfirmationCodeHandler()))
+	mux.HandleFunc("DELETE /me", userService.TokenMiddleware(userService.DeleteAccountHandler()))
+	mux.HandleFunc("GET /users/{id}", userService.PublicProfileHandler())
+	mux.HandleFunc("POST /me/2fa/enroll", userService.TokenMiddleware(userService.EnrollTwoFactorHandler()))
+	mux.HandleFunc("POST /me/2fa/confirm", userService.TokenMiddleware(userService.ConfirmTwoFactorHandler()))
+	mux.HandleFunc("POST /me/passkeys/register/begin", userService.TokenMiddleware(userService.BeginPasskeyRegistrationHandler()))
+	mux.HandleFunc("POST /me/passkeys/register/finish", userService.TokenMiddleware(userService.FinishPasskeyRegistrationHandler()))
+	mux.HandleFunc("GET /me/passkeys", userService.TokenMiddleware(userService.PasskeysHandler()))
+	mux.HandleFunc("DELETE /me/passkeys/{id}", userService.TokenMiddleware(userService.DeletePasskeyHandler()))
+	mux.HandleFunc("GET /me/tokens", userService.TokenMiddleware(userService.PersonalAccessTokensHandler()))
+	mux.HandleFunc("POST /me/tokens", userService.TokenMiddleware(userService.CreatePersonalAccessTokenHandler()))
+	mux.HandleFunc("DELETE /me/tokens/{id}", userService.TokenMiddleware(userService.RevokePersonalAccessTokenHandler()))
+
+	mux.HandleFunc("GET /admin/users", userService.TokenMiddleware(userService.UsersHandler()))
+	mux.HandleFunc("POST /admin/users/{id}/suspend", userService.TokenMiddleware(userService.SuspendUserHandler()))
+	mux.HandleFunc("POST /admin/users/{id}/ban", userService.TokenMiddleware(userService.BanUserHandler()))
+	mux.HandleFunc("POST /admin/users/{id}/reinstate", userService.TokenMiddleware(userService.ReinstateUserHandler()))
+	mux.HandleFunc("POST /admin/users/{id}/impersonate", userService.TokenMiddleware(userService.ImpersonateUserHandler()))
+	mux.HandleFunc("GET /admin/invites", userService.TokenMiddleware(userService.InvitesHandler()))
+	mux.HandleFunc("POST /admin/invites", userService.TokenMiddleware(userService.CreateInviteHandler()))
+	mux.HandleFunc("DELETE /admin/invites/{id}", userService.TokenMiddleware(userService.RevokeInviteHandler()))
+	mux.HandleFunc("GET /admin/users/{id}/audit", userService.TokenMiddleware(userService.AuditLogHandler()))
+
+	mux.HandleFunc("GET /posts", userService.OptionalTokenMiddleware(postService.PostsHandler()))
+	mux.HandleFunc("POST /posts", userService.ScopedTokenMiddleware(user.ScopePostsWrite, postService.CreatePostHandler()))
+	mux.HandleFunc("GET /posts/{id}", userService.OptionalTokenMiddleware(postService.PostHandler()))
+	mux.HandleFunc("PUT /posts/{id}", userService.ScopedTokenMiddleware(user.ScopePostsWrite, postService.UpdatePostHandler()))
+	mux.HandleFunc("DELETE /posts/{id}", userService.ScopedTokenMiddleware(user.ScopePostsWrite, postService.DeletePostHandler()))
+
+	mux.HandleFunc("GET /posts/{id}/revisions", userService.TokenMiddleware(postService.RevisionsHandler()))
+	mux.HandleFunc("GET /posts/{id}/revisions/{rev}", userService.TokenMiddleware(postService.RevisionHandler()))
+	mux.HandleFunc("POST /posts/{id}/revisions/{rev}/restore", userService.ScopedTokenMiddleware(user.ScopePostsWrite, postService.RestoreRevisionHandler()))
+
+	mux.HandleFunc("GET /posts/{id}/comments", userService.OptionalTokenMiddleware(postService.CommentsHandler()))
+	mux.HandleFunc("POST /posts/{id}/comments", userService.OptionalTokenMiddleware(postService.CreateCommentHandler()))
+	mux.HandleFunc("DELETE /posts/{id}/comments/{commentID}", userService.ScopedTokenMiddleware(user.ScopeCommentsModerate, postService.DeleteCommentHandler()))
 
-	mux.HandleFunc("GET /posts", postService.PostsHandler())
-	mux.HandleFunc("POST /posts", user.TokenMiddleware(postService.CreatePostHandler()))
-	mux.HandleFunc("GET /posts/{id}", postService.PostHandler())
-	mux.HandleFunc("PUT /posts/{id}", user.TokenMiddleware(postService.UpdatePostHandler()))
-	mux.HandleFunc("DELETE /posts/{id}", user.TokenMiddleware(postService.DeletePostHandler()))
+	// "/posts/by-slug/{slug}" overlaps "/posts/{id}/comments" and the like
+	// without either being more specific, which one mux refuses. It gets its
+	// own mux in front of the rest instead.
+	root := http.NewServeMux()
+	root.HandleFunc("GET /posts/by-slug/{slug}", userService.OptionalTokenMiddleware(postService.PostBySlugHandler()))
+	root.Handle("/", mux)
 
-	mux.HandleFunc("GET /posts/{id}/comments", postService.CommentsHandler())
-	mux.HandleFunc("POST /posts/{id}/comments", postService.CreateCommentHandler())
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	go session.Sweep(ctx, sessions, time.Minute)
+	go session.Sweep(ctx, refreshTokens, time.Hour)
+	go session.Sweep(ctx, accountLimiter, time.Minute)
+	go session.Sweep(ctx, ipLimiter, time.Minute)
+	go session.Sweep(ctx, magicLinkLimiter, time.Minute)
+	go session.Sweep(ctx, mailLimiter, time.Minute)
+	go postService.PublishScheduled(ctx, 30*time.Second)
 
 	srv := &http.Server{
-		Handler:      mux,
+		Handler:      server.TrustProxies(initTrustedProxies(), root),
 		Addr:         ":8080",
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 10 * time.Second,
 	}
 
-	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
-	defer stop()
-
 	go func() {
 		fmt.Println("Server is running on http://localhost:8080")
 		if err := srv.ListenAndServe(); err != nil {
@@ -76,3 +193,196 @@ func initDB() *sql.DB {
 
 	return db
 }
+
+func initSessionStores(db *sql.DB) (session.Store, session.RefreshStore) {
+	cfg := session.DefaultConfig
+	cfg.Lifetime = envDuration("SESSION_LIFETIME", cfg.Lifetime)
+	cfg.IdleTimeout = envDuration("SESSION_IDLE_TIMEOUT", cfg.IdleTimeout)
+	cfg.RefreshLifetime = envDuration("REFRESH_TOKEN_LIFETIME", cfg.RefreshLifetime)
+
+	switch os.Getenv("SESSION_STORE") {
+	case "memory":
+		return session.NewMemoryStore(cfg), session.NewMemoryRefreshStore(cfg)
+	default:
+		return session.NewMySQLStore(db, cfg), session.NewMySQLRefreshStore(db, cfg)
+	}
+}
+
+// initMailer sends mail through SMTP_ADDR when set. Otherwise messages are
+// appended to MAIL_SINK_FILE, or printed to stdout.
+func initMailer() mailer.Mailer {
+	from := envString("MAIL_FROM", "no-reply@localhost")
+	if addr := os.Getenv("SMTP_ADDR"); addr != "" {
+		return mailer.NewSMTPMailer(mailer.SMTPConfig{
+			Addr:     addr,
+			From:     from,
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+		})
+	}
+
+	path := os.Getenv("MAIL_SINK_FILE")
+	if path == "" {
+		return mailer.NewSinkMailer(from, os.Stdout)
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		log.Fatalf("open mail sink: %v", err)
+	}
+	return mailer.NewSinkMailer(from, f)
+}
+
+// initHasher reads PASSWORD_HASH, either "argon2id" or "bcrypt".
+func initHasher() *passwd.Hasher {
+	algorithm := envString("PASSWORD_HASH", passwd.Argon2id)
+	if algorithm != passwd.Argon2id && algorithm != passwd.Bcrypt {
+		log.Fatalf("invalid PASSWORD_HASH %q", algorithm)
+	}
+	return passwd.NewHasher(algorithm)
+}
+
+func initPasswordPolicy() *passwd.Policy {
+	p := passwd.DefaultPolicy
+	p.MinLength = envInt("PASSWORD_MIN_LENGTH", p.MinLength)
+	p.RejectCommon = os.Getenv("PASSWORD_ALLOW_COMMON") != "true"
+	return &p
+}
+
+// initRegistrationMode reads REGISTRATION_MODE, one of "open", "invite" or
+// "closed".
+func initRegistrationMode() user.RegistrationMode {
+	mode := user.RegistrationMode(envString("REGISTRATION_MODE", string(user.RegistrationOpen)))
+	switch mode {
+	case user.RegistrationOpen, user.RegistrationInvite, user.RegistrationClosed:
+		return mode
+	}
+	log.Fatalf("invalid REGISTRATION_MODE %q", mode)
+	return ""
+}
+
+// initDeletionMode reads ACCOUNT_DELETION, either "delete" or "anonymize".
+func initDeletionMode() user.DeletionMode {
+	mode := user.DeletionMode(envString("ACCOUNT_DELETION", string(user.DeleteHard)))
+	if mode != user.DeleteHard && mode != user.DeleteAnonymize {
+		log.Fatalf("invalid ACCOUNT_DELETION %q", mode)
+	}
+	return mode
+}
+
+// initOIDC configures single sign-on from OIDC_ISSUER, OIDC_CLIENT_ID,
+// OIDC_CLIENT_SECRET and OIDC_REDIRECT_URL. It is disabled when no issuer is
+// set.
+func initOIDC() *oidc.Provider {
+	issuer := os.Getenv("OIDC_ISSUER")
+	if issuer == "" {
+		return nil
+	}
+
+	return oidc.NewProvider(oidc.Config{
+		Issuer:       issuer,
+		ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+	})
+}
+
+// initWebAuthn configures passkeys from WEBAUTHN_RP_ID, WEBAUTHN_RP_NAME and
+// the comma separated WEBAUTHN_ORIGINS, defaulting to the host and origin of
+// baseURL.
+func initWebAuthn(baseURL string) *webauthn.RelyingParty {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		log.Fatalf("invalid BASE_URL: %v", err)
+	}
+
+	origins := []string{u.Scheme + "://" + u.Host}
+	if v := os.Getenv("WEBAUTHN_ORIGINS"); v != "" {
+		origins = strings.Split(v, ",")
+	}
+
+	return webauthn.New(webauthn.Config{
+		RPID:    envString("WEBAUTHN_RP_ID", u.Hostname()),
+		RPName:  envString("WEBAUTHN_RP_NAME", "app"),
+		Origins: origins,
+	})
+}
+
+// initSigner loads the JWT signing key from JWT_SIGNING_KEY and keys that
+// are being rotated out from the comma separated JWT_RETIRED_KEYS, both in
+// the "kid:alg:base64" format.
+func initSigner() *jwt.Signer {
+	issuer := envString("JWT_ISSUER", "app")
+
+	spec := os.Getenv("JWT_SIGNING_KEY")
+	if spec == "" {
+		log.Println("JWT_SIGNING_KEY is not set, using an ephemeral key")
+		key, err := jwt.GenerateHS256Key("ephemeral")
+		if err != nil {
+			log.Fatalf("generate signing key: %v", err)
+		}
+		return jwt.NewSigner(issuer, key)
+	}
+
+	active, err := jwt.ParseKey(spec)
+	if err != nil {
+		log.Fatalf("invalid JWT_SIGNING_KEY: %v", err)
+	}
+
+	var retired []jwt.Key
+	for _, spec := range strings.Split(os.Getenv("JWT_RETIRED_KEYS"), ",") {
+		if spec == "" {
+			continue
+		}
+		key, err := jwt.ParseKey(spec)
+		if err != nil {
+			log.Fatalf("invalid JWT_RETIRED_KEYS: %v", err)
+		}
+		retired = append(retired, key)
+	}
+	return jwt.NewSigner(issuer, active, retired...)
+}
+
+// initTrustedProxies reads TRUSTED_PROXIES, the comma separated CIDRs or IPs
+// of the reverse proxies whose X-Forwarded-For is believed. Leave it empty
+// when clients connect directly.
+func initTrustedProxies() []netip.Prefix {
+	prefixes, err := server.ParsePrefixes(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		log.Fatalf("invalid TRUSTED_PROXIES: %v", err)
+	}
+	return prefixes
+}
+
+func envString(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func envInt(key string, fallback int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("invalid integer for %s: %v", key, err)
+	}
+	return n
+}
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("invalid duration for %s: %v", key, err)
+	}
+	return d
+}
@@ -0,0 +1,269 @@
+package oidc
+
+import (
+	"app/jwt"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrDiscovery = errors.New("oidc discovery failed")
+	ErrExchange  = errors.New("oidc code exchange failed")
+	ErrIDToken   = errors.New("invalid id token")
+)
+
+type Config struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	HTTPClient   *http.Client
+}
+
+type metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// IDClaims are the ID token claims the login flow relies on.
+type IDClaims struct {
+	jwt.Claims
+	Nonce         string `json:"nonce"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Name          string `json:"name"`
+}
+
+// Provider talks to an OpenID provider using the authorization code flow
+// with PKCE. Discovery happens lazily on first use and the provider keys are
+// refetched when a token is signed by a key it does not know yet.
+type Provider struct {
+	cfg Config
+
+	m    sync.Mutex
+	meta *metadata
+	keys *jwt.KeySet
+}
+
+func NewProvider(cfg Config) *Provider {
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "email", "profile"}
+	}
+	cfg.Issuer = strings.TrimSuffix(cfg.Issuer, "/")
+	return &Provider{cfg: cfg}
+}
+
+// AuthRequest holds the per login secrets that must survive the round trip
+// to the provider.
+type AuthRequest struct {
+	State        string
+	Nonce        string
+	CodeVerifier string
+}
+
+func NewAuthRequest() (AuthRequest, error) {
+	var req AuthRequest
+	for _, v := range []*string{&req.State, &req.Nonce, &req.CodeVerifier} {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return AuthRequest{}, err
+		}
+		*v = base64.RawURLEncoding.EncodeToString(b)
+	}
+	return req, nil
+}
+
+// AuthCodeURL returns the provider URL the user agent is redirected to.
+func (p *Provider) AuthCodeURL(ctx context.Context, req AuthRequest) (string, error) {
+	meta, err := p.metadata(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	challenge := sha256.Sum256([]byte(req.CodeVerifier))
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", p.cfg.ClientID)
+	q.Set("redirect_uri", p.cfg.RedirectURL)
+	q.Set("scope", strings.Join(p.cfg.Scopes, " "))
+	q.Set("state", req.State)
+	q.Set("nonce", req.Nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return meta.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+// Exchange redeems an authorization code and returns the verified ID token
+// claims.
+func (p *Provider) Exchange(ctx context.Context, code string, req AuthRequest) (IDClaims, error) {
+	meta, err := p.metadata(ctx)
+	if err != nil {
+		return IDClaims{}, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.cfg.RedirectURL)
+	form.Set("client_id", p.cfg.ClientID)
+	form.Set("code_verifier", req.CodeVerifier)
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return IDClaims{}, err
+	}
+	httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	httpReq.Header.Set("Accept", "application/json")
+	if p.cfg.ClientSecret != "" {
+		httpReq.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	}
+
+	resp, err := p.cfg.HTTPClient.Do(httpReq)
+	if err != nil {
+		return IDClaims{}, fmt.Errorf("%w: %v", ErrExchange, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return IDClaims{}, fmt.Errorf("%w: %v", ErrExchange, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return IDClaims{}, fmt.Errorf("%w: status %d: %s", ErrExchange, resp.StatusCode, body)
+	}
+
+	var tokenResp struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(body, &tokenResp); err != nil {
+		return IDClaims{}, fmt.Errorf("%w: %v", ErrExchange, err)
+	}
+	if tokenResp.IDToken == "" {
+		return IDClaims{}, fmt.Errorf("%w: no id_token in response", ErrExchange)
+	}
+
+	return p.verifyIDToken(ctx, tokenResp.IDToken, req.Nonce)
+}
+
+func (p *Provider) verifyIDToken(ctx context.Context, rawIDToken, nonce string) (IDClaims, error) {
+	keys, err := p.keySet(ctx, rawIDToken)
+	if err != nil {
+		return IDClaims{}, err
+	}
+
+	var claims IDClaims
+	err = keys.Verify(rawIDToken, p.cfg.Issuer, p.cfg.ClientID, &claims)
+	if err != nil {
+		return IDClaims{}, fmt.Errorf("%w: %v", ErrIDToken, err)
+	}
+	if claims.Nonce != nonce {
+		return IDClaims{}, fmt.Errorf("%w: nonce mismatch", ErrIDToken)
+	}
+	if claims.Subject == "" {
+		return IDClaims{}, fmt.Errorf("%w: missing subject", ErrIDToken)
+	}
+	return claims, nil
+}
+
+func (p *Provider) metadata(ctx context.Context) (*metadata, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	if p.meta != nil {
+		return p.meta, nil
+	}
+
+	var meta metadata
+	err := p.getJSON(ctx, p.cfg.Issuer+"/.well-known/openid-configuration", &meta)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDiscovery, err)
+	}
+	if strings.TrimSuffix(meta.Issuer, "/") != p.cfg.Issuer {
+		return nil, fmt.Errorf("%w: issuer %q does not match %q", ErrDiscovery, meta.Issuer, p.cfg.Issuer)
+	}
+
+	p.meta = &meta
+	return p.meta, nil
+}
+
+// keySet returns the provider keys, refetching them when rawIDToken names a
+// key that is not cached, which happens after the provider rotates keys.
+func (p *Provider) keySet(ctx context.Context, rawIDToken string) (*jwt.KeySet, error) {
+	meta, err := p.metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	kid, err := jwt.KeyID(rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrIDToken, err)
+	}
+
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	if p.keys != nil && p.keys.HasKey(kid) {
+		return p.keys, nil
+	}
+
+	resp, err := p.get(ctx, meta.JWKSURI)
+	if err != nil {
+		return nil, fmt.Errorf("fetch jwks: %w", err)
+	}
+
+	keys, err := jwt.ParseJWKS(resp)
+	if err != nil {
+		return nil, err
+	}
+	p.keys = keys
+	return p.keys, nil
+}
+
+func (p *Provider) getJSON(ctx context.Context, url string, v any) error {
+	body, err := p.get(ctx, url)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
+
+func (p *Provider) get(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: status %d", url, resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
@@ -0,0 +1,289 @@
+package oidc
+
+import (
+	"app/jwt"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testClientID     = "client"
+	testClientSecret = "secret"
+	testRedirectURL  = "https://app.example/auth/oidc/callback"
+)
+
+// testIdP is a stand-in OpenID provider. It hands out codes for logins
+// started with authorize and signs ID tokens with its current key, publishing
+// every key it ever used in its JWKS.
+type testIdP struct {
+	t   *testing.T
+	srv *httptest.Server
+
+	m         sync.Mutex
+	issuer    string
+	signer    *jwt.Signer
+	jwks      []map[string]string
+	jwksFetch int
+	codes     map[string]pendingLogin
+	// tamper edits the claims of the next ID tokens.
+	tamper func(*IDClaims)
+}
+
+type pendingLogin struct {
+	challenge string
+	nonce     string
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	idp := &testIdP{t: t, codes: make(map[string]pendingLogin)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", idp.discovery)
+	mux.HandleFunc("GET /jwks", idp.keys)
+	mux.HandleFunc("POST /token", idp.token)
+	idp.srv = httptest.NewServer(mux)
+	t.Cleanup(idp.srv.Close)
+
+	idp.issuer = idp.srv.URL
+	idp.rotate("key-1")
+	return idp
+}
+
+// rotate makes a fresh key with id kid the signing key.
+func (idp *testIdP) rotate(kid string) {
+	seed := make([]byte, ed25519.SeedSize)
+	_, err := rand.Read(seed)
+	require.NoError(idp.t, err)
+
+	key, err := jwt.NewEdDSAKey(kid, seed)
+	require.NoError(idp.t, err)
+
+	idp.m.Lock()
+	defer idp.m.Unlock()
+	idp.signer = jwt.NewSigner(idp.srv.URL, key)
+	idp.jwks = append(idp.jwks, map[string]string{
+		"kty": "OKP",
+		"crv": "Ed25519",
+		"use": "sig",
+		"kid": kid,
+		"x":   base64.RawURLEncoding.EncodeToString(ed25519.NewKeyFromSeed(seed).Public().(ed25519.PublicKey)),
+	})
+}
+
+// authorize plays the user signing in at the provider and returns the code
+// the provider redirects back with.
+func (idp *testIdP) authorize(authURL string) string {
+	u, err := url.Parse(authURL)
+	require.NoError(idp.t, err)
+
+	q := u.Query()
+	require.Equal(idp.t, testClientID, q.Get("client_id"))
+	require.Equal(idp.t, testRedirectURL, q.Get("redirect_uri"))
+	require.Equal(idp.t, "S256", q.Get("code_challenge_method"))
+
+	code := base64.RawURLEncoding.EncodeToString([]byte(q.Get("state")))
+	idp.m.Lock()
+	defer idp.m.Unlock()
+	idp.codes[code] = pendingLogin{challenge: q.Get("code_challenge"), nonce: q.Get("nonce")}
+	return code
+}
+
+func (idp *testIdP) discovery(w http.ResponseWriter, r *http.Request) {
+	idp.m.Lock()
+	defer idp.m.Unlock()
+	json.NewEncoder(w).Encode(map[string]string{
+		"issuer":                 idp.issuer,
+		"authorization_endpoint": idp.srv.URL + "/authorize",
+		"token_endpoint":         idp.srv.URL + "/token",
+		"jwks_uri":               idp.srv.URL + "/jwks",
+	})
+}
+
+func (idp *testIdP) keys(w http.ResponseWriter, r *http.Request) {
+	idp.m.Lock()
+	defer idp.m.Unlock()
+	idp.jwksFetch++
+	json.NewEncoder(w).Encode(map[string]any{"keys": idp.jwks})
+}
+
+func (idp *testIdP) token(w http.ResponseWriter, r *http.Request) {
+	idp.m.Lock()
+	defer idp.m.Unlock()
+
+	clientID, secret, ok := r.BasicAuth()
+	if !ok || clientID != testClientID || secret != testClientSecret {
+		http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+		return
+	}
+
+	login, ok := idp.codes[r.FormValue("code")]
+	delete(idp.codes, r.FormValue("code"))
+	challenge := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	if !ok || r.FormValue("grant_type") != "authorization_code" ||
+		base64.RawURLEncoding.EncodeToString(challenge[:]) != login.challenge {
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	claims := IDClaims{
+		Claims: jwt.Claims{
+			Issuer:    idp.srv.URL,
+			Subject:   "user-1",
+			Audience:  jwt.Audience{testClientID},
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(5 * time.Minute).Unix(),
+		},
+		Nonce:         login.nonce,
+		Email:         "user@example.com",
+		EmailVerified: true,
+		Name:          "User",
+	}
+	if idp.tamper != nil {
+		idp.tamper(&claims)
+	}
+
+	idToken, err := idp.signer.Sign(claims)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"id_token": idToken, "token_type": "Bearer"})
+}
+
+func newTestProvider(idp *testIdP) *Provider {
+	return NewProvider(Config{
+		Issuer:       idp.srv.URL,
+		ClientID:     testClientID,
+		ClientSecret: testClientSecret,
+		RedirectURL:  testRedirectURL,
+		HTTPClient:   idp.srv.Client(),
+	})
+}
+
+// login runs the whole authorization code flow against idp.
+func login(t *testing.T, p *Provider, idp *testIdP) (IDClaims, error) {
+	ctx := context.Background()
+	req, err := NewAuthRequest()
+	require.NoError(t, err)
+
+	authURL, err := p.AuthCodeURL(ctx, req)
+	require.NoError(t, err)
+
+	return p.Exchange(ctx, idp.authorize(authURL), req)
+}
+
+func TestDiscovery(t *testing.T) {
+	idp := newTestIdP(t)
+
+	authURL, err := newTestProvider(idp).AuthCodeURL(context.Background(), AuthRequest{State: "s", Nonce: "n", CodeVerifier: "v"})
+	require.NoError(t, err)
+
+	u, err := url.Parse(authURL)
+	require.NoError(t, err)
+	require.Equal(t, idp.srv.URL+"/authorize", u.Scheme+"://"+u.Host+u.Path)
+	require.Equal(t, "code", u.Query().Get("response_type"))
+	require.Equal(t, "openid email profile", u.Query().Get("scope"))
+
+	idp.issuer = "https://other.example"
+	_, err = newTestProvider(idp).AuthCodeURL(context.Background(), AuthRequest{})
+	require.ErrorIs(t, err, ErrDiscovery)
+}
+
+func TestExchange(t *testing.T) {
+	idp := newTestIdP(t)
+	p := newTestProvider(idp)
+
+	claims, err := login(t, p, idp)
+	require.NoError(t, err)
+	require.Equal(t, "user-1", claims.Subject)
+	require.Equal(t, "user@example.com", claims.Email)
+	require.True(t, claims.EmailVerified)
+}
+
+func TestExchangeWrongCodeVerifier(t *testing.T) {
+	idp := newTestIdP(t)
+	p := newTestProvider(idp)
+	ctx := context.Background()
+
+	req, err := NewAuthRequest()
+	require.NoError(t, err)
+	authURL, err := p.AuthCodeURL(ctx, req)
+	require.NoError(t, err)
+	code := idp.authorize(authURL)
+
+	req.CodeVerifier = "guessed"
+	_, err = p.Exchange(ctx, code, req)
+	require.ErrorIs(t, err, ErrExchange)
+}
+
+func TestKeyRotation(t *testing.T) {
+	idp := newTestIdP(t)
+	p := newTestProvider(idp)
+
+	_, err := login(t, p, idp)
+	require.NoError(t, err)
+	_, err = login(t, p, idp)
+	require.NoError(t, err)
+	require.Equal(t, 1, idp.jwksFetch, "known keys are cached")
+
+	idp.rotate("key-2")
+	_, err = login(t, p, idp)
+	require.NoError(t, err)
+	require.Equal(t, 2, idp.jwksFetch, "an unknown key triggers a refetch")
+
+	_, err = login(t, p, idp)
+	require.NoError(t, err)
+	require.Equal(t, 2, idp.jwksFetch)
+}
+
+func TestIDTokenRejected(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(*IDClaims)
+	}{
+		{"wrong nonce", func(c *IDClaims) { c.Nonce = "replayed" }},
+		{"wrong issuer", func(c *IDClaims) { c.Issuer = "https://evil.example" }},
+		{"wrong audience", func(c *IDClaims) { c.Audience = jwt.Audience{"other-client"} }},
+		{"expired", func(c *IDClaims) { c.ExpiresAt = time.Now().Add(-time.Hour).Unix() }},
+		{"missing subject", func(c *IDClaims) { c.Subject = "" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp := newTestIdP(t)
+			idp.tamper = tt.tamper
+
+			_, err := login(t, newTestProvider(idp), idp)
+			require.ErrorIs(t, err, ErrIDToken)
+		})
+	}
+}
+
+func TestIDTokenUnknownKey(t *testing.T) {
+	idp := newTestIdP(t)
+	p := newTestProvider(idp)
+
+	_, err := login(t, p, idp)
+	require.NoError(t, err)
+
+	// A key the provider never published.
+	seed := make([]byte, ed25519.SeedSize)
+	key, err := jwt.NewEdDSAKey("key-1", seed)
+	require.NoError(t, err)
+	idp.signer = jwt.NewSigner(idp.srv.URL, key)
+
+	_, err = login(t, p, idp)
+	require.ErrorIs(t, err, ErrIDToken)
+}
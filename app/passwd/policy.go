@@ -0,0 +1,56 @@
+package passwd
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// common.txt lists frequently used passwords, one per line, lower case.
+//
+//go:embed common.txt
+var commonList string
+
+var common = func() map[string]struct{} {
+	m := make(map[string]struct{})
+	sc := bufio.NewScanner(strings.NewReader(commonList))
+	for sc.Scan() {
+		if line := strings.TrimSpace(sc.Text()); line != "" {
+			m[line] = struct{}{}
+		}
+	}
+	return m
+}()
+
+// Policy is the set of rules a new password must satisfy. MaxBytes defaults
+// to bcrypt's input limit, beyond which bcrypt silently ignores the rest.
+type Policy struct {
+	MinLength    int
+	MaxBytes     int
+	RejectCommon bool
+}
+
+var DefaultPolicy = Policy{
+	MinLength:    8,
+	MaxBytes:     72,
+	RejectCommon: true,
+}
+
+// Validate returns every rule password breaks, or nil.
+func (p Policy) Validate(password string) []string {
+	var problems []string
+	if utf8.RuneCountInString(password) < p.MinLength {
+		problems = append(problems, fmt.Sprintf("must be at least %d characters", p.MinLength))
+	}
+	if p.MaxBytes > 0 && len(password) > p.MaxBytes {
+		problems = append(problems, fmt.Sprintf("must be at most %d bytes", p.MaxBytes))
+	}
+	if p.RejectCommon {
+		if _, ok := common[strings.ToLower(password)]; ok {
+			problems = append(problems, "is too common")
+		}
+	}
+	return problems
+}
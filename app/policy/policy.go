@@ -0,0 +1,94 @@
+package policy
+
+type Role string
+
+const (
+	RoleAdmin  Role = "admin"
+	RoleEditor Role = "editor"
+	RoleAuthor Role = "author"
+	RoleReader Role = "reader"
+)
+
+func (r Role) Valid() bool {
+	switch r {
+	case RoleAdmin, RoleEditor, RoleAuthor, RoleReader:
+		return true
+	}
+	return false
+}
+
+type Action string
+
+const (
+	ActionCreatePost  Action = "post:create"
+	ActionUpdatePost  Action = "post:update"
+	ActionDeletePost  Action = "post:delete"
+	ActionManageUsers Action = "user:manage"
+	// ActionModerateComment is about the post the comment is on, so Own
+	// lets authors moderate comments on their own posts.
+	ActionModerateComment Action = "comment:moderate"
+)
+
+// Grant is how far a permission reaches: only resources the actor owns, or
+// any resource.
+type Grant int
+
+const (
+	None Grant = iota
+	Own
+	Any
+)
+
+// Actor is the user performing an action.
+type Actor struct {
+	ID   int
+	Role Role
+}
+
+type Policy struct {
+	rules map[Role]map[Action]Grant
+}
+
+// New returns the default policy: admins may do anything, editors manage
+// every post and its comments, authors manage their own posts and their
+// comments and readers only read.
+func New() *Policy {
+	return &Policy{
+		rules: map[Role]map[Action]Grant{
+			RoleAdmin: {
+				ActionCreatePost:      Any,
+				ActionUpdatePost:      Any,
+				ActionDeletePost:      Any,
+				ActionManageUsers:     Any,
+				ActionModerateComment: Any,
+			},
+			RoleEditor: {
+				ActionCreatePost:      Own,
+				ActionUpdatePost:      Any,
+				ActionDeletePost:      Any,
+				ActionModerateComment: Any,
+			},
+			RoleAuthor: {
+				ActionCreatePost:      Own,
+				ActionUpdatePost:      Own,
+				ActionDeletePost:      Own,
+				ActionModerateComment: Own,
+			},
+			RoleReader: {},
+		},
+	}
+}
+
+// Can reports whether actor may perform action on a resource owned by
+// ownerID. Actions that are not about an existing resource, like creating
+// one, pass the actor's own ID.
+func (p *Policy) Can(actor Actor, action Action, ownerID int) bool {
+	switch p.rules[actor.Role][action] {
+	case Any:
+		return true
+	case Own:
+		return actor.ID == ownerID
+	default:
+		return false
+	}
+}
@@ -0,0 +1,176 @@
+package post
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var ErrDiffTooLarge = errors.New("texts too large to compare")
+
+// maxDiffTokens bounds the tokens of both texts together, which bounds the
+// time a diff takes.
+const maxDiffTokens = 20000
+
+// Diff operations.
+const (
+	DiffEqual  = "equal"
+	DiffInsert = "insert"
+	DiffDelete = "delete"
+)
+
+// DiffOp is a run of text that is kept, inserted or deleted going from the
+// old to the new version.
+type DiffOp struct {
+	Op   string `json:"op"`
+	Text string `json:"text"`
+}
+
+var wordPattern = regexp.MustCompile(`\s+|\S+`)
+
+// splitLines splits s into lines, keeping the line breaks so the pieces join
+// back into s.
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// splitWords splits s into runs of whitespace and non-whitespace.
+func splitWords(s string) []string {
+	return wordPattern.FindAllString(s, -1)
+}
+
+// diff compares the tokens of a and b with the linear space variant of
+// Myers' algorithm and merges consecutive tokens with the same operation.
+// It takes O(len(a)+len(b)) memory and O((len(a)+len(b))*D) time for D
+// edits, so callers bound the input with maxDiffTokens.
+func diff(a, b []string) ([]DiffOp, error) {
+	if len(a)+len(b) > maxDiffTokens {
+		return nil, fmt.Errorf("%w: %d tokens, at most %d", ErrDiffTooLarge, len(a)+len(b), maxDiffTokens)
+	}
+
+	size := 2*((len(a)+len(b)+1)/2) + 3
+	d := differ{a: a, b: b, fwd: make([]int, size), bwd: make([]int, size), ops: []DiffOp{}}
+	d.compare(0, len(a), 0, len(b))
+	return d.ops, nil
+}
+
+type differ struct {
+	a, b []string
+	// fwd and bwd hold the furthest x reached on each diagonal by the
+	// forward and the backward search, shared by all middleSnake calls.
+	fwd, bwd []int
+	ops      []DiffOp
+}
+
+// compare appends the edits from a[a0:a1] to b[b0:b1].
+func (d *differ) compare(a0, a1, b0, b1 int) {
+	for a0 < a1 && b0 < b1 && d.a[a0] == d.b[b0] {
+		d.emit(DiffEqual, d.a[a0])
+		a0++
+		b0++
+	}
+	suffix := 0
+	for a0 < a1-suffix && b0 < b1-suffix && d.a[a1-suffix-1] == d.b[b1-suffix-1] {
+		suffix++
+	}
+	a1 -= suffix
+	b1 -= suffix
+
+	switch {
+	case a0 == a1:
+		for _, t := range d.b[b0:b1] {
+			d.emit(DiffInsert, t)
+		}
+	case b0 == b1:
+		for _, t := range d.a[a0:a1] {
+			d.emit(DiffDelete, t)
+		}
+	default:
+		// Both sides differ at their ends, so there are at least two
+		// edits and the snake splits them into smaller problems.
+		x, y, u, v := d.middleSnake(a0, a1, b0, b1)
+		d.compare(a0, x, b0, y)
+		for _, t := range d.a[x:u] {
+			d.emit(DiffEqual, t)
+		}
+		d.compare(u, a1, v, b1)
+	}
+
+	for _, t := range d.a[a1 : a1+suffix] {
+		d.emit(DiffEqual, t)
+	}
+}
+
+// middleSnake searches from both ends of a[a0:a1] and b[b0:b1] until the
+// paths meet and returns the run of equal tokens from (x, y) to (u, v) in
+// the middle of an edit script with the fewest edits.
+func (d *differ) middleSnake(a0, a1, b0, b1 int) (x, y, u, v int) {
+	n, m := a1-a0, b1-b0
+	delta := n - m
+	odd := delta%2 != 0
+	maxD := (n + m + 1) / 2
+	offset := maxD + 1
+	fwd, bwd := d.fwd, d.bwd
+	fwd[offset+1] = 0
+	bwd[offset+1] = 0
+
+	for D := 0; D <= maxD; D++ {
+		for k := -D; k <= D; k += 2 {
+			var x int
+			if k == -D || (k != D && fwd[offset+k-1] < fwd[offset+k+1]) {
+				x = fwd[offset+k+1]
+			} else {
+				x = fwd[offset+k-1] + 1
+			}
+			y := x - k
+			x0, y0 := x, y
+			for x < n && y < m && d.a[a0+x] == d.b[b0+y] {
+				x++
+				y++
+			}
+			fwd[offset+k] = x
+
+			// The backward search counts x from the end, on diagonal
+			// delta-k.
+			if c := delta - k; odd && c >= -(D-1) && c <= D-1 && x+bwd[offset+c] >= n {
+				return a0 + x0, b0 + y0, a0 + x, b0 + y
+			}
+		}
+
+		for c := -D; c <= D; c += 2 {
+			var x int
+			if c == -D || (c != D && bwd[offset+c-1] < bwd[offset+c+1]) {
+				x = bwd[offset+c+1]
+			} else {
+				x = bwd[offset+c-1] + 1
+			}
+			y := x - c
+			x0, y0 := x, y
+			for x < n && y < m && d.a[a1-x-1] == d.b[b1-y-1] {
+				x++
+				y++
+			}
+			bwd[offset+c] = x
+
+			if k := delta - c; !odd && k >= -D && k <= D && x+fwd[offset+k] >= n {
+				return a1 - x, b1 - y, a1 - x0, b1 - y0
+			}
+		}
+	}
+	panic("diff: paths did not meet")
+}
+
+// emit appends a token, merging it into the last op when that has the same
+// operation.
+func (d *differ) emit(op, text string) {
+	if last := len(d.ops) - 1; last >= 0 && d.ops[last].Op == op {
+		d.ops[last].Text += text
+		return
+	}
+	d.ops = append(d.ops, DiffOp{Op: op, Text: text})
+}
@@ -1,6 +1,7 @@
 package post
 
 import (
+	"app/policy"
 	"app/repository"
 	"app/server"
 	"app/user"
@@ -15,20 +16,26 @@ import (
 )
 
 var (
-	ErrNotFound      = errors.New("not found")
-	ErrNotAuthorized = errors.New("not authorized")
+	ErrNotFound         = errors.New("not found")
+	ErrNotAuthorized    = errors.New("not authorized")
+	ErrEmailNotVerified = errors.New("email not verified")
 )
 
 type Post struct {
-	ID        int    `json:"id"`
-	Title     string `json:"title"`
-	Content   string `json:"content"`
-	AuthorID  int    `json:"author_id"`
-	CreatedAt string `json:"created_at"`
-	UpdatedAt string `json:"updated_at"`
+	ID          int        `json:"id"`
+	Slug        string     `json:"slug"`
+	Title       string     `json:"title"`
+	Content     string     `json:"content"`
+	AuthorID    int        `json:"author_id"`
+	Status      Status     `json:"status"`
+	PublishedAt *time.Time `json:"published_at"`
+	CreatedAt   string     `json:"created_at"`
+	UpdatedAt   string     `json:"updated_at"`
 }
 
 type Comment struct {
+	ID        int    `json:"id"`
+	AuthorID  int    `json:"author_id,omitempty"`
 	Author    string `json:"author"`
 	Content   string `json:"content"`
 	CreatedAt string `json:"created_at"`
@@ -36,6 +43,10 @@ type Comment struct {
 
 type PostsParam struct {
 	AuthorID int
+	Status   Status
+	// ViewerID is the user listing the posts, 0 when anonymous. Posts that
+	// are not published are only listed for their author.
+	ViewerID int
 	PaginationParam
 }
 
@@ -44,12 +55,25 @@ type PaginationParam struct {
 	Size int
 }
 
+type Config struct {
+	Policy *policy.Policy
+	// RequireVerifiedEmail stops users who have not verified their email
+	// address from creating posts.
+	RequireVerifiedEmail bool
+}
+
 type Service struct {
-	db *sql.DB
+	db                   *sql.DB
+	policy               *policy.Policy
+	requireVerifiedEmail bool
 }
 
-func NewService(db *sql.DB) *Service {
-	return &Service{db: db}
+func NewService(db *sql.DB, cfg Config) *Service {
+	return &Service{
+		db:                   db,
+		policy:               cfg.Policy,
+		requireVerifiedEmail: cfg.RequireVerifiedEmail,
+	}
 }
 
 func (s *Service) PostHandler() func(http.ResponseWriter, *http.Request) {
@@ -61,7 +85,7 @@ func (s *Service) PostHandler() func(http.ResponseWriter, *http.Request) {
 			return
 		}
 
-		p := s.Post(r.Context(), id)
+		p := s.Post(r.Context(), id, user.IDFromContext(r.Context()))
 		if p == nil {
 			server.ErrorResponse(w, http.StatusNotFound, ErrNotFound)
 			return
@@ -71,10 +95,11 @@ func (s *Service) PostHandler() func(http.ResponseWriter, *http.Request) {
 	}
 }
 
-func (s *Service) Post(ctx context.Context, id int) *Post {
+// Post returns the post with id if viewerID may see it.
+func (s *Service) Post(ctx context.Context, id int, viewerID int) *Post {
 	repo := repository.New(s.db)
 	p := repo.Post(ctx, id)
-	if p == nil {
+	if p == nil || !visible(p, viewerID) {
 		return nil
 	}
 
@@ -97,6 +122,11 @@ func (s *Service) PostsHandler() func(http.ResponseWriter, *http.Request) {
 			}
 		}
 
+		status := Status(urlParams.Get("status"))
+		if status != "" && !status.valid() {
+			errs = append(errs, fmt.Errorf("%w: %q", ErrInvalidStatus, status))
+		}
+
 		pageStr := urlParams.Get("page")
 		page := 1
 		if pageStr != "" {
@@ -126,6 +156,8 @@ func (s *Service) PostsHandler() func(http.ResponseWriter, *http.Request) {
 
 		params := PostsParam{
 			AuthorID: authorID,
+			Status:   status,
+			ViewerID: user.IDFromContext(r.Context()),
 			PaginationParam: PaginationParam{
 				Page: page,
 				Size: size,
@@ -149,7 +181,9 @@ func (s *Service) PostsHandler() func(http.ResponseWriter, *http.Request) {
 func (s *Service) Posts(ctx context.Context, param PostsParam) ([]Post, int) {
 	repo := repository.New(s.db)
 	repoParam := repository.PostsParam{
-		AuthorID: param.AuthorID,
+		AuthorID:  param.AuthorID,
+		Status:    string(param.Status),
+		VisibleTo: param.ViewerID,
 	}
 	repoParam.Page = param.Page
 	repoParam.Size = param.Size
@@ -173,7 +207,11 @@ func (s *Service) CreatePostHandler() func(http.ResponseWriter, *http.Request) {
 
 		err := s.CreatePost(r.Context(), input)
 		if err != nil {
-			server.ErrorResponse(w, http.StatusBadRequest, err)
+			status := http.StatusBadRequest
+			if errors.Is(err, ErrNotAuthorized) || errors.Is(err, ErrEmailNotVerified) {
+				status = http.StatusForbidden
+			}
+			server.ErrorResponse(w, status, err)
 			return
 		}
 
@@ -181,17 +219,39 @@ func (s *Service) CreatePostHandler() func(http.ResponseWriter, *http.Request) {
 	}
 }
 
+// CreatePost stores a new post. Posts without a status are published right
+// away.
 func (s *Service) CreatePost(ctx context.Context, data Post) error {
-	err := s.execInTx(ctx, func(r *repository.Repository) error {
+	if data.Status == "" {
+		data.Status = StatusPublished
+	}
+
+	err := s.execWithSlug(ctx, func(r *repository.Repository) error {
 		u := r.User(ctx, data.AuthorID)
 		if u == nil {
 			return fmt.Errorf("invalid author with id %d: %w", data.AuthorID, ErrNotFound)
 		}
 
+		if !s.policy.Can(actor(u), policy.ActionCreatePost, u.ID) {
+			return fmt.Errorf("unable to create post: %w", ErrNotAuthorized)
+		}
+
+		if s.requireVerifiedEmail && u.EmailVerifiedAt == nil {
+			return fmt.Errorf("unable to create post: %w", ErrEmailNotVerified)
+		}
+
+		status, publishedAt, err := transition("", nil, data.Status, data.PublishedAt, time.Now())
+		if err != nil {
+			return err
+		}
+
 		return r.CreatePost(ctx, repository.Post{
-			AuthorID: u.ID,
-			Title:    data.Title,
-			Content:  data.Content,
+			AuthorID:    u.ID,
+			Slug:        uniqueSlug(ctx, r, data.Title, 0),
+			Title:       data.Title,
+			Content:     data.Content,
+			Status:      string(status),
+			PublishedAt: publishedAt,
 		})
 	})
 
@@ -221,6 +281,8 @@ func (s *Service) UpdatePostHandler() func(http.ResponseWriter, *http.Request) {
 				status = http.StatusForbidden
 			case errors.Is(err, ErrNotFound):
 				status = http.StatusNotFound
+			case errors.Is(err, ErrInvalidStatus):
+				status = http.StatusBadRequest
 			}
 			server.ErrorResponse(w, status, err)
 			return
@@ -230,21 +292,31 @@ func (s *Service) UpdatePostHandler() func(http.ResponseWriter, *http.Request) {
 	}
 }
 
+// UpdatePost edits the post and moves it to data.Status, keeping the current
+// status when none is given.
 func (s *Service) UpdatePost(ctx context.Context, id int, data Post) error {
-	err := s.execInTx(ctx, func(r *repository.Repository) error {
+	err := s.execWithSlug(ctx, func(r *repository.Repository) error {
 		p := r.Post(ctx, id)
 		if p == nil {
 			return fmt.Errorf("unable to update post with id %d: %w", id, ErrNotFound)
 		}
 
-		if p.AuthorID != data.AuthorID {
-			return fmt.Errorf("unable to update post with id %d: %w", id, ErrNotAuthorized)
+		err := s.authorize(ctx, r, data.AuthorID, policy.ActionUpdatePost, p.AuthorID)
+		if err != nil {
+			return fmt.Errorf("unable to update post with id %d: %w", id, err)
+		}
+
+		status, publishedAt, err := transition(Status(p.Status), p.PublishedAt, data.Status, data.PublishedAt, time.Now())
+		if err != nil {
+			return err
 		}
 
-		return r.UpdatePost(ctx, p.ID, repository.Post{
-			AuthorID: data.AuthorID,
-			Title:    data.Title,
-			Content:  data.Content,
+		return s.updatePost(ctx, r, p, repository.Post{
+			AuthorID:    p.AuthorID,
+			Title:       data.Title,
+			Content:     data.Content,
+			Status:      string(status),
+			PublishedAt: publishedAt,
 		})
 	})
 
@@ -286,8 +358,9 @@ func (s *Service) DeletePost(ctx context.Context, id int, authorId int) error {
 			return fmt.Errorf("unable to delete post with id %d: %w", id, ErrNotFound)
 		}
 
-		if p.AuthorID != authorId {
-			return fmt.Errorf("unable to delete post with id %d: %w", id, ErrNotAuthorized)
+		err := s.authorize(ctx, r, authorId, policy.ActionDeletePost, p.AuthorID)
+		if err != nil {
+			return fmt.Errorf("unable to delete post with id %d: %w", id, err)
 		}
 
 		return r.DeletePost(ctx, p.ID, p.AuthorID)
@@ -305,7 +378,11 @@ func (s *Service) CommentsHandler() func(http.ResponseWriter, *http.Request) {
 			return
 		}
 
-		cs := s.Comments(r.Context(), id)
+		cs := s.Comments(r.Context(), id, user.IDFromContext(r.Context()))
+		if cs == nil {
+			server.ErrorResponse(w, http.StatusNotFound, ErrNotFound)
+			return
+		}
 
 		output := struct {
 			PostID   int       `json:"post_id"`
@@ -318,8 +395,15 @@ func (s *Service) CommentsHandler() func(http.ResponseWriter, *http.Request) {
 	}
 }
 
-func (s *Service) Comments(ctx context.Context, postID int) []Comment {
+// Comments returns the comments on the post, or nil when viewerID may not
+// see the post.
+func (s *Service) Comments(ctx context.Context, postID int, viewerID int) []Comment {
 	repo := repository.New(s.db)
+	p := repo.Post(ctx, postID)
+	if p == nil || !visible(p, viewerID) {
+		return nil
+	}
+
 	cs := repo.Comments(ctx, postID)
 
 	res := make([]Comment, 0, len(cs))
@@ -340,6 +424,7 @@ func (s *Service) CreateCommentHandler() func(http.ResponseWriter, *http.Request
 
 		var input Comment
 		json.NewDecoder(r.Body).Decode(&input)
+		input.AuthorID = user.IDFromContext(r.Context())
 
 		err = s.CreateComment(r.Context(), id, input)
 		if err != nil {
@@ -354,12 +439,18 @@ func (s *Service) CreateCommentHandler() func(http.ResponseWriter, *http.Request
 func (s *Service) CreateComment(ctx context.Context, postID int, data Comment) error {
 	err := s.execInTx(ctx, func(r *repository.Repository) error {
 		p := r.Post(ctx, postID)
-		if p == nil {
+		if p == nil || !visible(p, data.AuthorID) {
 			return ErrNotFound
 		}
 
+		var authorID *int
+		if data.AuthorID > 0 {
+			authorID = &data.AuthorID
+		}
+
 		return r.CreateComment(ctx, postID, repository.Comment{
 			PostID:     p.ID,
+			AuthorID:   authorID,
 			AuthorName: data.Author,
 			Content:    data.Content,
 		})
@@ -368,6 +459,76 @@ func (s *Service) CreateComment(ctx context.Context, postID int, data Comment) e
 	return err
 }
 
+func (s *Service) DeleteCommentHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			server.ErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		commentID, err := strconv.Atoi(r.PathValue("commentID"))
+		if err != nil {
+			server.ErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		err = s.DeleteComment(r.Context(), id, commentID, user.IDFromContext(r.Context()))
+		if err != nil {
+			status := http.StatusInternalServerError
+			switch {
+			case errors.Is(err, ErrNotAuthorized):
+				status = http.StatusForbidden
+			case errors.Is(err, ErrNotFound):
+				status = http.StatusNotFound
+			}
+			server.ErrorResponse(w, status, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// DeleteComment removes a comment from the post. Moderating is granted per
+// post, see policy.ActionModerateComment.
+func (s *Service) DeleteComment(ctx context.Context, postID, commentID int, actorID int) error {
+	return s.execInTx(ctx, func(r *repository.Repository) error {
+		p := r.Post(ctx, postID)
+		if p == nil {
+			return fmt.Errorf("post with id %d: %w", postID, ErrNotFound)
+		}
+
+		err := s.authorize(ctx, r, actorID, policy.ActionModerateComment, p.AuthorID)
+		if err != nil {
+			return fmt.Errorf("unable to delete comment %d: %w", commentID, err)
+		}
+
+		n, err := r.DeleteComment(ctx, commentID, p.ID)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("comment %d on post %d: %w", commentID, postID, ErrNotFound)
+		}
+		return nil
+	})
+}
+
+// authorize checks that the user actorID may perform action on a resource
+// owned by ownerID.
+func (s *Service) authorize(ctx context.Context, r *repository.Repository, actorID int, action policy.Action, ownerID int) error {
+	u := r.User(ctx, actorID)
+	if u == nil {
+		return fmt.Errorf("unknown user with id %d: %w", actorID, ErrNotAuthorized)
+	}
+
+	if !s.policy.Can(actor(u), action, ownerID) {
+		return ErrNotAuthorized
+	}
+	return nil
+}
+
 func (s *Service) execInTx(ctx context.Context, fn func(*repository.Repository) error) error {
 	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
@@ -387,19 +548,33 @@ func (s *Service) execInTx(ctx context.Context, fn func(*repository.Repository)
 	return tx.Commit()
 }
 
+func actor(u *repository.User) policy.Actor {
+	return policy.Actor{ID: u.ID, Role: policy.Role(u.Role)}
+}
+
 func mapPostRepoToService(data repository.Post) Post {
 	return Post{
-		ID:        data.ID,
-		Title:     data.Title,
-		Content:   data.Content,
-		AuthorID:  data.AuthorID,
-		CreatedAt: data.CreatedAt.Format(time.DateTime),
-		UpdatedAt: data.UpdatedAt.Format(time.DateTime),
+		ID:          data.ID,
+		Slug:        data.Slug,
+		Title:       data.Title,
+		Content:     data.Content,
+		AuthorID:    data.AuthorID,
+		Status:      Status(data.Status),
+		PublishedAt: data.PublishedAt,
+		CreatedAt:   data.CreatedAt.Format(time.DateTime),
+		UpdatedAt:   data.UpdatedAt.Format(time.DateTime),
 	}
 }
 
 func mapCommentRepoToService(data repository.Comment) Comment {
+	var authorID int
+	if data.AuthorID != nil {
+		authorID = *data.AuthorID
+	}
+
 	return Comment{
+		ID:        data.ID,
+		AuthorID:  authorID,
 		Author:    data.AuthorName,
 		Content:   data.Content,
 		CreatedAt: data.CreatedAt.Format(time.DateTime),
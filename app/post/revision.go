@@ -0,0 +1,253 @@
+package post
+
+import (
+	"app/policy"
+	"app/repository"
+	"app/server"
+	"app/user"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Revision is a version of a post that was replaced by an edit.
+type Revision struct {
+	Rev       int    `json:"rev"`
+	Title     string `json:"title"`
+	Content   string `json:"content"`
+	CreatedAt string `json:"created_at"`
+}
+
+// RevisionDiff describes the changes from a revision to the current version
+// of the post.
+type RevisionDiff struct {
+	Title   []DiffOp `json:"title"`
+	Content []DiffOp `json:"content"`
+}
+
+func (s *Service) RevisionsHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			server.ErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		revs, err := s.Revisions(r.Context(), id, user.IDFromContext(r.Context()))
+		if err != nil {
+			writeRevisionError(w, err)
+			return
+		}
+
+		output := struct {
+			PostID int        `json:"post_id"`
+			Data   []Revision `json:"data"`
+		}{
+			PostID: id,
+			Data:   revs,
+		}
+		server.JSONResponse(w, http.StatusOK, output)
+	}
+}
+
+// Revisions lists the earlier versions of the post, newest first. Only users
+// who may edit the post can see them.
+func (s *Service) Revisions(ctx context.Context, postID int, actorID int) ([]Revision, error) {
+	repo := repository.New(s.db)
+	p := repo.Post(ctx, postID)
+	if p == nil {
+		return nil, fmt.Errorf("post with id %d: %w", postID, ErrNotFound)
+	}
+
+	err := s.authorize(ctx, repo, actorID, policy.ActionUpdatePost, p.AuthorID)
+	if err != nil {
+		return nil, err
+	}
+
+	revs := repo.PostRevisions(ctx, p.ID)
+	res := make([]Revision, 0, len(revs))
+	for _, rv := range revs {
+		res = append(res, mapRevisionRepoToService(rv))
+	}
+	return res, nil
+}
+
+func (s *Service) RevisionHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			server.ErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		rev, err := strconv.Atoi(r.PathValue("rev"))
+		if err != nil {
+			server.ErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		split := splitLines
+		switch r.URL.Query().Get("by") {
+		case "", "line":
+		case "word":
+			split = splitWords
+		default:
+			server.ErrorResponse(w, http.StatusBadRequest, errors.New(`by must be "line" or "word"`))
+			return
+		}
+
+		revision, current, err := s.Revision(r.Context(), id, rev, user.IDFromContext(r.Context()))
+		if err != nil {
+			writeRevisionError(w, err)
+			return
+		}
+
+		var d RevisionDiff
+		d.Title, err = diff(split(revision.Title), split(current.Title))
+		if err == nil {
+			d.Content, err = diff(split(revision.Content), split(current.Content))
+		}
+		if err != nil {
+			server.ErrorResponse(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+
+		output := struct {
+			Revision Revision     `json:"revision"`
+			Diff     RevisionDiff `json:"diff"`
+		}{
+			Revision: revision,
+			Diff:     d,
+		}
+		server.JSONResponse(w, http.StatusOK, output)
+	}
+}
+
+// Revision returns revision rev of the post together with the current
+// version to compare it against.
+func (s *Service) Revision(ctx context.Context, postID, rev int, actorID int) (Revision, Post, error) {
+	repo := repository.New(s.db)
+	p := repo.Post(ctx, postID)
+	if p == nil {
+		return Revision{}, Post{}, fmt.Errorf("post with id %d: %w", postID, ErrNotFound)
+	}
+
+	err := s.authorize(ctx, repo, actorID, policy.ActionUpdatePost, p.AuthorID)
+	if err != nil {
+		return Revision{}, Post{}, err
+	}
+
+	rv := repo.PostRevision(ctx, p.ID, rev)
+	if rv == nil {
+		return Revision{}, Post{}, fmt.Errorf("revision %d of post %d: %w", rev, postID, ErrNotFound)
+	}
+	return mapRevisionRepoToService(*rv), mapPostRepoToService(*p), nil
+}
+
+func (s *Service) RestoreRevisionHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			server.ErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		rev, err := strconv.Atoi(r.PathValue("rev"))
+		if err != nil {
+			server.ErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		err = s.RestoreRevision(r.Context(), id, rev, user.IDFromContext(r.Context()))
+		if err != nil {
+			writeRevisionError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// RestoreRevision makes revision rev the current title and content of the
+// post. The version it replaces becomes a revision itself, so a restore can
+// be undone.
+func (s *Service) RestoreRevision(ctx context.Context, postID, rev int, actorID int) error {
+	return s.execWithSlug(ctx, func(r *repository.Repository) error {
+		p := r.Post(ctx, postID)
+		if p == nil {
+			return fmt.Errorf("unable to restore post with id %d: %w", postID, ErrNotFound)
+		}
+
+		err := s.authorize(ctx, r, actorID, policy.ActionUpdatePost, p.AuthorID)
+		if err != nil {
+			return fmt.Errorf("unable to restore post with id %d: %w", postID, err)
+		}
+
+		rv := r.PostRevision(ctx, p.ID, rev)
+		if rv == nil {
+			return fmt.Errorf("revision %d of post %d: %w", rev, postID, ErrNotFound)
+		}
+
+		return s.updatePost(ctx, r, p, repository.Post{
+			AuthorID:    p.AuthorID,
+			Title:       rv.Title,
+			Content:     rv.Content,
+			Status:      p.Status,
+			PublishedAt: p.PublishedAt,
+		})
+	})
+}
+
+// updatePost stores data as the new version of p, keeping the current title
+// and content as a revision when they change. A new title also gets a new
+// slug, the old one is kept to redirect from. It must run in the
+// transaction that locked p.
+func (s *Service) updatePost(ctx context.Context, r *repository.Repository, p *repository.Post, data repository.Post) error {
+	data.Slug = p.Slug
+	if data.Title != p.Title {
+		data.Slug = uniqueSlug(ctx, r, data.Title, p.ID)
+	}
+	if data.Slug != p.Slug {
+		err := r.MovePostSlug(ctx, p.ID, p.Slug, data.Slug)
+		if err != nil {
+			return fmt.Errorf("unable to keep old slug of post %d: %w", p.ID, err)
+		}
+	}
+
+	if data.Title != p.Title || data.Content != p.Content {
+		err := r.CreatePostRevision(ctx, repository.PostRevision{
+			PostID:    p.ID,
+			Title:     p.Title,
+			Content:   p.Content,
+			CreatedAt: time.Now(),
+		})
+		if err != nil {
+			return fmt.Errorf("unable to save revision of post %d: %w", p.ID, err)
+		}
+	}
+
+	return r.UpdatePost(ctx, p.ID, data)
+}
+
+func writeRevisionError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrNotAuthorized):
+		status = http.StatusForbidden
+	case errors.Is(err, ErrNotFound):
+		status = http.StatusNotFound
+	}
+	server.ErrorResponse(w, status, err)
+}
+
+func mapRevisionRepoToService(data repository.PostRevision) Revision {
+	return Revision{
+		Rev:       data.Rev,
+		Title:     data.Title,
+		Content:   data.Content,
+		CreatedAt: data.CreatedAt.Format(time.DateTime),
+	}
+}
@@ -0,0 +1,124 @@
+package post
+
+import (
+	"app/repository"
+	"app/server"
+	"app/user"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// maxSlugLength caps generated slugs in runes, leaving room for the suffix
+// that makes them unique.
+const maxSlugLength = 100
+
+// maxSlugAttempts bounds how often a write is retried after a concurrent
+// one took the slug it picked.
+const maxSlugAttempts = 3
+
+// slugify turns title into a lower case slug of letters, digits and dashes.
+// Letters of any script are kept as they are, so a title in Cyrillic or CJK
+// still gives a readable slug. The title is normalized to NFC first, so the
+// same title typed with precomposed or combining accents gets one slug.
+func slugify(title string) string {
+	var b strings.Builder
+	var n int
+	dash := false
+	for _, r := range strings.ToLower(norm.NFC.String(title)) {
+		if !unicode.IsLetter(r) && !unicode.IsNumber(r) && !unicode.Is(unicode.Mn, r) {
+			dash = true
+			continue
+		}
+		if n == maxSlugLength {
+			break
+		}
+		if dash && n > 0 {
+			b.WriteByte('-')
+			n++
+		}
+		dash = false
+		b.WriteRune(r)
+		n++
+	}
+
+	slug := strings.TrimRight(b.String(), "-")
+	if slug == "" {
+		return "post"
+	}
+	return slug
+}
+
+// uniqueSlug returns the slug for title, numbering it when another post
+// uses or used it before. Slugs already belonging to postID are reused.
+func uniqueSlug(ctx context.Context, r *repository.Repository, title string, postID int) string {
+	base := slugify(title)
+	slug := base
+	for i := 2; ; i++ {
+		id := r.PostIDWithSlug(ctx, slug)
+		if id == 0 || id == postID {
+			return slug
+		}
+		slug = fmt.Sprintf("%s-%d", base, i)
+	}
+}
+
+// execWithSlug runs fn in a transaction that picks a slug with uniqueSlug.
+// Another transaction can take the same slug before fn inserts it, which
+// fails on the unique key or as a deadlock on the locked range, so fn is
+// run again in a fresh transaction that sees the taken slug.
+func (s *Service) execWithSlug(ctx context.Context, fn func(*repository.Repository) error) error {
+	var err error
+	for range maxSlugAttempts {
+		err = s.execInTx(ctx, fn)
+		if !repository.IsDuplicate(err) && !repository.IsDeadlock(err) {
+			return err
+		}
+	}
+	return err
+}
+
+func (s *Service) PostBySlugHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		slug := r.PathValue("slug")
+
+		p, moved := s.PostBySlug(r.Context(), slug, user.IDFromContext(r.Context()))
+		if p == nil {
+			server.ErrorResponse(w, http.StatusNotFound, ErrNotFound)
+			return
+		}
+		if moved {
+			http.Redirect(w, r, "/posts/by-slug/"+url.PathEscape(p.Slug), http.StatusMovedPermanently)
+			return
+		}
+
+		server.JSONResponse(w, http.StatusOK, p)
+	}
+}
+
+// PostBySlug returns the post with slug if viewerID may see it. moved
+// reports that slug is a former slug of the post.
+func (s *Service) PostBySlug(ctx context.Context, slug string, viewerID int) (*Post, bool) {
+	repo := repository.New(s.db)
+	p := repo.PostWithSlug(ctx, slug)
+	moved := false
+	if p == nil {
+		old := repo.PostSlug(ctx, slug)
+		if old == nil {
+			return nil, false
+		}
+		p = repo.Post(ctx, old.PostID)
+		moved = true
+	}
+	if p == nil || !visible(p, viewerID) {
+		return nil, false
+	}
+
+	res := mapPostRepoToService(*p)
+	return &res, moved
+}
@@ -0,0 +1,93 @@
+package post
+
+import (
+	"app/repository"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Status is the lifecycle state of a post. Only published posts are shown
+// to anyone but their author.
+type Status string
+
+const (
+	StatusDraft     Status = "draft"
+	StatusScheduled Status = "scheduled"
+	StatusPublished Status = "published"
+	StatusArchived  Status = "archived"
+)
+
+var ErrInvalidStatus = errors.New("invalid status")
+
+func (st Status) valid() bool {
+	switch st {
+	case StatusDraft, StatusScheduled, StatusPublished, StatusArchived:
+		return true
+	}
+	return false
+}
+
+// transition works out the status and publish time of a post moving from
+// current to next. An empty next keeps the current status, at is the
+// requested publish time of a scheduled post.
+func transition(current Status, publishedAt *time.Time, next Status, at *time.Time, now time.Time) (Status, *time.Time, error) {
+	if next == "" {
+		next = current
+	}
+	if !next.valid() {
+		return "", nil, fmt.Errorf("%w: %q", ErrInvalidStatus, next)
+	}
+
+	switch next {
+	case StatusDraft:
+		return next, nil, nil
+	case StatusScheduled:
+		if at == nil && current == StatusScheduled {
+			at = publishedAt
+		}
+		if at == nil || !at.After(now) {
+			return "", nil, fmt.Errorf("%w: scheduled posts need a future published_at", ErrInvalidStatus)
+		}
+		return next, at, nil
+	case StatusPublished:
+		if current == StatusPublished && publishedAt != nil {
+			return next, publishedAt, nil
+		}
+		return next, &now, nil
+	default:
+		return next, publishedAt, nil
+	}
+}
+
+// visible reports whether the user viewerID, 0 for anonymous readers, may
+// see p.
+func visible(p *repository.Post, viewerID int) bool {
+	return Status(p.Status) == StatusPublished || (viewerID > 0 && p.AuthorID == viewerID)
+}
+
+// PublishScheduled publishes scheduled posts once their publish time has
+// passed, checking every interval until ctx is cancelled. The schedule lives
+// in the database, so posts that fell due while the app was down go out on
+// the first check.
+func (s *Service) PublishScheduled(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		n, err := repository.New(s.db).PublishDuePosts(ctx, time.Now())
+		if err != nil {
+			slog.Error("failed to publish scheduled posts", "err", err)
+		} else if n > 0 {
+			slog.Info("published scheduled posts", "count", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
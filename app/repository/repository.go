@@ -3,12 +3,23 @@ package repository
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log/slog"
 	"strings"
 	"time"
 
 	"github.com/georgysavva/scany/v2/dbscan"
+	"github.com/go-sql-driver/mysql"
+)
+
+// MySQL server error numbers.
+const (
+	// mysqlErrDuplicateEntry is the number for unique key violations.
+	mysqlErrDuplicateEntry = 1062
+	// mysqlErrDeadlock is the number of a transaction rolled back to break
+	// a deadlock.
+	mysqlErrDeadlock = 1213
 )
 
 type DB interface {
@@ -22,33 +33,158 @@ type Repository struct {
 }
 
 type User struct {
-	ID           int    `db:"id"`
-	Name         string `db:"name"`
-	Email        string `db:"email"`
-	PasswordHash string `db:"password_hash"`
-	CreatedAt    time.Time
-	UpdatedAt    time.Time
+	ID              int     `db:"id"`
+	Name            string  `db:"name"`
+	Email           string  `db:"email"`
+	PasswordHash    string  `db:"password_hash"`
+	Role            string  `db:"role"`
+	TOTPSecret      *string `db:"totp_secret"`
+	TOTPEnabled     bool    `db:"totp_enabled"`
+	TOTPLastStep    int64   `db:"totp_last_step"`
+	EmailVerifiedAt *time.Time
+	Bio             string `db:"bio"`
+	AvatarURL       string `db:"avatar_url"`
+	Website         string `db:"website"`
+	Status          string `db:"status"`
+	SuspendedUntil  *time.Time
+	TokenGeneration int `db:"token_generation"`
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+}
+
+// UserIdentity links an account to a subject at an external identity
+// provider.
+type UserIdentity struct {
+	ID        int    `db:"id"`
+	Issuer    string `db:"issuer"`
+	Subject   string `db:"subject"`
+	UserID    int    `db:"user_id"`
+	CreatedAt time.Time
+}
+
+// UserToken is a single use token sent to a user, e.g. in a password reset
+// email.
+type UserToken struct {
+	TokenHash string `db:"token_hash"`
+	UserID    int    `db:"user_id"`
+	Purpose   string `db:"purpose"`
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt    *time.Time
 }
 
 type Post struct {
+	ID          int    `db:"id"`
+	AuthorID    int    `db:"author_id"`
+	Slug        string `db:"slug"`
+	Title       string `db:"title"`
+	Content     string `db:"content"`
+	Status      string `db:"status"`
+	PublishedAt *time.Time
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// PostSlug is a former slug of a post.
+type PostSlug struct {
+	Slug      string `db:"slug"`
+	PostID    int    `db:"post_id"`
+	CreatedAt time.Time
+}
+
+type PostRevision struct {
 	ID        int    `db:"id"`
-	AuthorID  int    `db:"author_id"`
+	PostID    int    `db:"post_id"`
+	Rev       int    `db:"rev"`
 	Title     string `db:"title"`
 	Content   string `db:"content"`
 	CreatedAt time.Time
-	UpdatedAt time.Time
 }
 
 type Comment struct {
 	ID         int
 	PostID     int
+	AuthorID   *int `db:"author_id"`
 	AuthorName string
 	Content    string
 	CreatedAt  time.Time
 }
 
+type Session struct {
+	TokenHash     string `db:"token_hash"`
+	ID            string `db:"id"`
+	UserID        int    `db:"user_id"`
+	IP            string `db:"ip"`
+	UserAgent     string `db:"user_agent"`
+	CreatedAt     time.Time
+	LastSeenAt    time.Time
+	ExpiresAt     time.Time
+	IdleExpiresAt time.Time
+}
+
+type RefreshToken struct {
+	TokenHash string `db:"token_hash"`
+	FamilyID  string `db:"family_id"`
+	UserID    int    `db:"user_id"`
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
+
+type PersonalAccessToken struct {
+	ID         int    `db:"id"`
+	UserID     int    `db:"user_id"`
+	Name       string `db:"name"`
+	TokenHash  string `db:"token_hash"`
+	Scopes     string `db:"scopes"`
+	CreatedAt  time.Time
+	ExpiresAt  *time.Time
+	LastUsedAt *time.Time
+}
+
+type WebAuthnCredential struct {
+	ID           int    `db:"id"`
+	UserID       int    `db:"user_id"`
+	Name         string `db:"name"`
+	CredentialID []byte `db:"credential_id"`
+	PublicKey    []byte `db:"public_key"`
+	SignCount    uint32 `db:"sign_count"`
+	CreatedAt    time.Time
+	LastUsedAt   *time.Time
+}
+
+type AuditLog struct {
+	ID           int    `db:"id"`
+	ActorID      *int   `db:"actor_id"`
+	Action       string `db:"action"`
+	TargetUserID *int   `db:"target_user_id"`
+	Detail       string `db:"detail"`
+	CreatedAt    time.Time
+}
+
+type Invite struct {
+	ID        int    `db:"id"`
+	CodeHash  string `db:"code_hash"`
+	Role      string `db:"role"`
+	MaxUses   int    `db:"max_uses"`
+	Uses      int    `db:"uses"`
+	ExpiresAt *time.Time
+	CreatedBy *int `db:"created_by"`
+	CreatedAt time.Time
+}
+
+type UsersParam struct {
+	Query  string
+	Status string
+	PaginationParam
+}
+
 type PostsParam struct {
 	AuthorID int
+	Status   string
+	// VisibleTo limits the result to published posts and those authored by
+	// the user VisibleTo.
+	VisibleTo int
 	PaginationParam
 }
 
@@ -61,6 +197,19 @@ func New(db DB) *Repository {
 	return &Repository{db: db}
 }
 
+// IsDuplicate reports whether err is a unique constraint violation.
+func IsDuplicate(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlErrDuplicateEntry
+}
+
+// IsDeadlock reports whether err rolled the transaction back to break a
+// deadlock, after which it may be retried.
+func IsDeadlock(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlErrDeadlock
+}
+
 func (r *Repository) User(ctx context.Context, id int) *User {
 	sqlQuery := r.selectQuery(`SELECT * FROM user WHERE id = ? LIMIT 1`)
 	rows, err := r.db.QueryContext(ctx, sqlQuery, id)
@@ -95,9 +244,296 @@ func (r *Repository) UserWithEmail(ctx context.Context, email string) *User {
 	return &res
 }
 
-func (r *Repository) CreateUser(ctx context.Context, data User) error {
-	sqlQuery := `INSERT INTO user (name, email, password_hash) VALUES(?, ?, ?)`
-	_, err := r.db.ExecContext(ctx, sqlQuery, data.Name, data.Email, data.PasswordHash)
+func (r *Repository) CreateUser(ctx context.Context, data User) (int, error) {
+	sqlQuery := `INSERT INTO user (name, email, password_hash, role, email_verified_at) VALUES(?, ?, ?, ?, ?)`
+	res, err := r.db.ExecContext(ctx, sqlQuery, data.Name, data.Email, data.PasswordHash, data.Role, data.EmailVerifiedAt)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := res.LastInsertId()
+	return int(id), err
+}
+
+func (r *Repository) UpdateUserTOTP(ctx context.Context, id int, secret *string, enabled bool) error {
+	sqlQuery := "UPDATE user SET totp_secret = ?, totp_enabled = ?, totp_last_step = 0 WHERE id = ?"
+	_, err := r.db.ExecContext(ctx, sqlQuery, secret, enabled, id)
+	return err
+}
+
+func (r *Repository) UpdateUserTOTPLastStep(ctx context.Context, id int, step int64) error {
+	sqlQuery := "UPDATE user SET totp_last_step = ? WHERE id = ?"
+	_, err := r.db.ExecContext(ctx, sqlQuery, step, id)
+	return err
+}
+
+func (r *Repository) CreateRecoveryCodes(ctx context.Context, userID int, codeHashes []string) error {
+	if len(codeHashes) == 0 {
+		return nil
+	}
+
+	sqlQuery := "INSERT INTO recovery_code (user_id, code_hash) VALUES"
+	args := make([]any, 0, len(codeHashes)*2)
+	for i, h := range codeHashes {
+		if i > 0 {
+			sqlQuery += ","
+		}
+		sqlQuery += " (?, ?)"
+		args = append(args, userID, h)
+	}
+	_, err := r.db.ExecContext(ctx, sqlQuery, args...)
+	return err
+}
+
+func (r *Repository) DeleteRecoveryCodes(ctx context.Context, userID int) error {
+	sqlQuery := "DELETE FROM recovery_code WHERE user_id = ?"
+	_, err := r.db.ExecContext(ctx, sqlQuery, userID)
+	return err
+}
+
+// UseRecoveryCode marks an unused recovery code as used and reports how many
+// codes were affected, zero when the code is unknown or already used.
+func (r *Repository) UseRecoveryCode(ctx context.Context, userID int, codeHash string, usedAt time.Time) (int64, error) {
+	sqlQuery := "UPDATE recovery_code SET used_at = ? WHERE user_id = ? AND code_hash = ? AND used_at IS NULL"
+	res, err := r.db.ExecContext(ctx, sqlQuery, usedAt, userID, codeHash)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// UpdateUserEmail changes the email of a user, the new address starts
+// unverified.
+func (r *Repository) UpdateUserEmail(ctx context.Context, id int, email string) error {
+	sqlQuery := "UPDATE user SET email = ?, email_verified_at = NULL WHERE id = ?"
+	_, err := r.db.ExecContext(ctx, sqlQuery, email, id)
+	return err
+}
+
+// Users searches users by a substring of their name or email.
+func (r *Repository) Users(ctx context.Context, param UsersParam) ([]User, int) {
+	if param.Page <= 0 {
+		param.Page = 1
+	}
+
+	if param.Size <= 0 {
+		param.Size = 20
+	}
+
+	sqlQuery := "SELECT * FROM user"
+	var where []string
+	var args []any
+
+	if param.Query != "" {
+		pattern := "%" + likeEscaper.Replace(param.Query) + "%"
+		where = append(where, "(name LIKE ? OR email LIKE ?)")
+		args = append(args, pattern, pattern)
+	}
+	if param.Status != "" {
+		where = append(where, "status = ?")
+		args = append(args, param.Status)
+	}
+	if len(where) > 0 {
+		sqlQuery += " WHERE " + strings.Join(where, " AND ")
+	}
+
+	total := r.count(ctx, sqlQuery, args...)
+	sqlQuery = r.paginationQuery(sqlQuery+" ORDER BY id", param.PaginationParam)
+	rows, err := r.db.QueryContext(ctx, sqlQuery, args...)
+	if err != nil {
+		return nil, 0
+	}
+
+	var res []User
+	dbscan.ScanAll(&res, rows)
+	return res, total
+}
+
+func (r *Repository) UpdateUserStatus(ctx context.Context, id int, status string, suspendedUntil *time.Time) error {
+	sqlQuery := "UPDATE user SET status = ?, suspended_until = ? WHERE id = ?"
+	_, err := r.db.ExecContext(ctx, sqlQuery, status, suspendedUntil, id)
+	return err
+}
+
+func (r *Repository) CreateAuditLog(ctx context.Context, data AuditLog) error {
+	sqlQuery := "INSERT INTO audit_log (actor_id, action, target_user_id, detail) VALUES(?, ?, ?, ?)"
+	_, err := r.db.ExecContext(ctx, sqlQuery, data.ActorID, data.Action, data.TargetUserID, data.Detail)
+	return err
+}
+
+func (r *Repository) AuditLogs(ctx context.Context, targetUserID int) []AuditLog {
+	sqlQuery := "SELECT * FROM audit_log WHERE target_user_id = ? ORDER BY id DESC"
+	rows, err := r.db.QueryContext(ctx, sqlQuery, targetUserID)
+	if err != nil {
+		return nil
+	}
+
+	var res []AuditLog
+	dbscan.ScanAll(&res, rows)
+	return res
+}
+
+func (r *Repository) InviteWithHash(ctx context.Context, codeHash string) *Invite {
+	sqlQuery := r.selectQuery("SELECT * FROM invite WHERE code_hash = ? LIMIT 1")
+	rows, err := r.db.QueryContext(ctx, sqlQuery, codeHash)
+	if err != nil {
+		slog.Error("failed to query invite", "err", err)
+		return nil
+	}
+
+	var res Invite
+	err = dbscan.ScanOne(&res, rows)
+	if err != nil {
+		return nil
+	}
+	return &res
+}
+
+func (r *Repository) Invites(ctx context.Context) []Invite {
+	sqlQuery := "SELECT * FROM invite ORDER BY id DESC"
+	rows, err := r.db.QueryContext(ctx, sqlQuery)
+	if err != nil {
+		return nil
+	}
+
+	var res []Invite
+	dbscan.ScanAll(&res, rows)
+	return res
+}
+
+func (r *Repository) CreateInvite(ctx context.Context, data Invite) (int, error) {
+	sqlQuery := "INSERT INTO invite (code_hash, role, max_uses, expires_at, created_by, created_at) VALUES(?, ?, ?, ?, ?, ?)"
+	res, err := r.db.ExecContext(ctx, sqlQuery, data.CodeHash, data.Role, data.MaxUses, data.ExpiresAt, data.CreatedBy,
+		data.CreatedAt)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := res.LastInsertId()
+	return int(id), err
+}
+
+func (r *Repository) UseInvite(ctx context.Context, id int) error {
+	sqlQuery := "UPDATE invite SET uses = uses + 1 WHERE id = ?"
+	_, err := r.db.ExecContext(ctx, sqlQuery, id)
+	return err
+}
+
+func (r *Repository) DeleteInvite(ctx context.Context, id int) (int64, error) {
+	sqlQuery := "DELETE FROM invite WHERE id = ?"
+	res, err := r.db.ExecContext(ctx, sqlQuery, id)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (r *Repository) UpdateUserProfile(ctx context.Context, id int, data User) error {
+	sqlQuery := "UPDATE user SET name = ?, bio = ?, avatar_url = ?, website = ? WHERE id = ?"
+	_, err := r.db.ExecContext(ctx, sqlQuery, data.Name, data.Bio, data.AvatarURL, data.Website, id)
+	return err
+}
+
+// AnonymizeUser replaces every personal detail of a user and leaves the
+// account without a usable password.
+func (r *Repository) AnonymizeUser(ctx context.Context, id int, name, email string) error {
+	sqlQuery := `UPDATE user SET name = ?, email = ?, password_hash = '', totp_secret = NULL, totp_enabled = FALSE,
+		totp_last_step = 0, email_verified_at = NULL, bio = '', avatar_url = '', website = '' WHERE id = ?`
+	_, err := r.db.ExecContext(ctx, sqlQuery, name, email, id)
+	return err
+}
+
+func (r *Repository) DeleteUser(ctx context.Context, id int) error {
+	sqlQuery := "DELETE FROM user WHERE id = ?"
+	_, err := r.db.ExecContext(ctx, sqlQuery, id)
+	return err
+}
+
+func (r *Repository) MarkUserEmailVerified(ctx context.Context, id int, verifiedAt time.Time) error {
+	sqlQuery := "UPDATE user SET email_verified_at = ? WHERE id = ?"
+	_, err := r.db.ExecContext(ctx, sqlQuery, verifiedAt, id)
+	return err
+}
+
+func (r *Repository) UpdateUserPassword(ctx context.Context, id int, passwordHash string) error {
+	sqlQuery := "UPDATE user SET password_hash = ? WHERE id = ?"
+	_, err := r.db.ExecContext(ctx, sqlQuery, passwordHash, id)
+	return err
+}
+
+// RevokeUserAccessTokens invalidates the access tokens issued to the user so
+// far by moving on to the next token generation.
+func (r *Repository) RevokeUserAccessTokens(ctx context.Context, id int) error {
+	sqlQuery := "UPDATE user SET token_generation = token_generation + 1 WHERE id = ?"
+	_, err := r.db.ExecContext(ctx, sqlQuery, id)
+	return err
+}
+
+func (r *Repository) UserToken(ctx context.Context, tokenHash, purpose string) *UserToken {
+	sqlQuery := r.selectQuery("SELECT * FROM user_token WHERE token_hash = ? AND purpose = ? LIMIT 1")
+	rows, err := r.db.QueryContext(ctx, sqlQuery, tokenHash, purpose)
+	if err != nil {
+		slog.Error("failed to query user token", "purpose", purpose, "err", err)
+		return nil
+	}
+
+	var res UserToken
+	err = dbscan.ScanOne(&res, rows)
+	if err != nil {
+		return nil
+	}
+	return &res
+}
+
+func (r *Repository) CreateUserToken(ctx context.Context, data UserToken) error {
+	sqlQuery := "INSERT INTO user_token (token_hash, user_id, purpose, expires_at) VALUES(?, ?, ?, ?)"
+	_, err := r.db.ExecContext(ctx, sqlQuery, data.TokenHash, data.UserID, data.Purpose, data.ExpiresAt)
+	return err
+}
+
+func (r *Repository) MarkUserTokenUsed(ctx context.Context, tokenHash string, usedAt time.Time) error {
+	sqlQuery := "UPDATE user_token SET used_at = ? WHERE token_hash = ?"
+	_, err := r.db.ExecContext(ctx, sqlQuery, usedAt, tokenHash)
+	return err
+}
+
+func (r *Repository) DeleteUserTokens(ctx context.Context, userID int, purpose string) error {
+	sqlQuery := "DELETE FROM user_token WHERE user_id = ? AND purpose = ?"
+	_, err := r.db.ExecContext(ctx, sqlQuery, userID, purpose)
+	return err
+}
+
+func (r *Repository) DeleteAllUserTokens(ctx context.Context, userID int) error {
+	sqlQuery := "DELETE FROM user_token WHERE user_id = ?"
+	_, err := r.db.ExecContext(ctx, sqlQuery, userID)
+	return err
+}
+
+func (r *Repository) DeleteUserIdentities(ctx context.Context, userID int) error {
+	sqlQuery := "DELETE FROM user_identity WHERE user_id = ?"
+	_, err := r.db.ExecContext(ctx, sqlQuery, userID)
+	return err
+}
+
+func (r *Repository) UserIdentity(ctx context.Context, issuer, subject string) *UserIdentity {
+	sqlQuery := r.selectQuery("SELECT * FROM user_identity WHERE issuer = ? AND subject = ? LIMIT 1")
+	rows, err := r.db.QueryContext(ctx, sqlQuery, issuer, subject)
+	if err != nil {
+		slog.Error("failed to query user identity", "issuer", issuer, "err", err)
+		return nil
+	}
+
+	var res UserIdentity
+	err = dbscan.ScanOne(&res, rows)
+	if err != nil {
+		return nil
+	}
+	return &res
+}
+
+func (r *Repository) CreateUserIdentity(ctx context.Context, data UserIdentity) error {
+	sqlQuery := "INSERT INTO user_identity (issuer, subject, user_id) VALUES(?, ?, ?)"
+	_, err := r.db.ExecContext(ctx, sqlQuery, data.Issuer, data.Subject, data.UserID)
 	return err
 }
 
@@ -125,13 +561,19 @@ func (r *Repository) Posts(ctx context.Context, param PostsParam) ([]Post, int)
 		param.Size = 10
 	}
 
-	sqlQuery := r.selectQuery("SELECT * FROM post")
-	var args []any
+	sqlQuery := "SELECT * FROM post"
+	where := []string{"(status = 'published' OR author_id = ?)"}
+	args := []any{param.VisibleTo}
 
 	if param.AuthorID > 0 {
-		sqlQuery += " WHERE author_id = ?"
+		where = append(where, "author_id = ?")
 		args = append(args, param.AuthorID)
 	}
+	if param.Status != "" {
+		where = append(where, "status = ?")
+		args = append(args, param.Status)
+	}
+	sqlQuery += " WHERE " + strings.Join(where, " AND ")
 
 	total := r.count(ctx, sqlQuery, args...)
 	sqlQuery = r.paginationQuery(sqlQuery, param.PaginationParam)
@@ -145,18 +587,137 @@ func (r *Repository) Posts(ctx context.Context, param PostsParam) ([]Post, int)
 	return res, total
 }
 
+func (r *Repository) AuthorPosts(ctx context.Context, authorID int) []Post {
+	sqlQuery := r.selectQuery("SELECT * FROM post WHERE author_id = ? ORDER BY id")
+	rows, err := r.db.QueryContext(ctx, sqlQuery, authorID)
+	if err != nil {
+		return nil
+	}
+
+	var res []Post
+	dbscan.ScanAll(&res, rows)
+	return res
+}
+
+func (r *Repository) CountPublishedPostsByAuthor(ctx context.Context, authorID int) int {
+	return r.count(ctx, "SELECT * FROM post WHERE author_id = ? AND status = 'published'", authorID)
+}
+
 func (r *Repository) CreatePost(ctx context.Context, data Post) error {
-	sqlQuery := "INSERT INTO post (title, content, author_id) VALUES(?, ?, ?)"
-	_, err := r.db.ExecContext(ctx, sqlQuery, data.Title, data.Content, data.AuthorID)
+	sqlQuery := "INSERT INTO post (slug, title, content, author_id, status, published_at) VALUES(?, ?, ?, ?, ?, ?)"
+	_, err := r.db.ExecContext(ctx, sqlQuery, data.Slug, data.Title, data.Content, data.AuthorID, data.Status, data.PublishedAt)
 	return err
 }
 
 func (r *Repository) UpdatePost(ctx context.Context, id int, data Post) error {
-	sqlQuery := "UPDATE post SET title = ?, content = ? WHERE id = ? AND author_id = ?"
-	_, err := r.db.ExecContext(ctx, sqlQuery, data.Title, data.Content, id, data.AuthorID)
+	sqlQuery := "UPDATE post SET slug = ?, title = ?, content = ?, status = ?, published_at = ? WHERE id = ? AND author_id = ?"
+	_, err := r.db.ExecContext(ctx, sqlQuery, data.Slug, data.Title, data.Content, data.Status, data.PublishedAt, id, data.AuthorID)
 	return err
 }
 
+func (r *Repository) PostWithSlug(ctx context.Context, slug string) *Post {
+	sqlQuery := r.selectQuery("SELECT * FROM post WHERE slug = ? LIMIT 1")
+	rows, err := r.db.QueryContext(ctx, sqlQuery, slug)
+	if err != nil {
+		return nil
+	}
+
+	var res Post
+	err = dbscan.ScanOne(&res, rows)
+	if err != nil {
+		return nil
+	}
+	return &res
+}
+
+func (r *Repository) PostSlug(ctx context.Context, slug string) *PostSlug {
+	sqlQuery := r.selectQuery("SELECT * FROM post_slug WHERE slug = ? LIMIT 1")
+	rows, err := r.db.QueryContext(ctx, sqlQuery, slug)
+	if err != nil {
+		return nil
+	}
+
+	var res PostSlug
+	err = dbscan.ScanOne(&res, rows)
+	if err != nil {
+		return nil
+	}
+	return &res
+}
+
+// PostIDWithSlug returns the id of the post that has or had slug, 0 if the
+// slug is free.
+func (r *Repository) PostIDWithSlug(ctx context.Context, slug string) int {
+	if p := r.PostWithSlug(ctx, slug); p != nil {
+		return p.ID
+	}
+	if s := r.PostSlug(ctx, slug); s != nil {
+		return s.PostID
+	}
+	return 0
+}
+
+// MovePostSlug records oldSlug as a former slug of the post that now goes by
+// newSlug. A post can take back one of its former slugs.
+func (r *Repository) MovePostSlug(ctx context.Context, postID int, oldSlug, newSlug string) error {
+	sqlQuery := "DELETE FROM post_slug WHERE slug = ? AND post_id = ?"
+	_, err := r.db.ExecContext(ctx, sqlQuery, newSlug, postID)
+	if err != nil {
+		return err
+	}
+
+	sqlQuery = "INSERT INTO post_slug (slug, post_id) VALUES(?, ?)"
+	_, err = r.db.ExecContext(ctx, sqlQuery, oldSlug, postID)
+	return err
+}
+
+func (r *Repository) PostRevisions(ctx context.Context, postID int) []PostRevision {
+	sqlQuery := r.selectQuery("SELECT * FROM post_revision WHERE post_id = ? ORDER BY rev DESC")
+	rows, err := r.db.QueryContext(ctx, sqlQuery, postID)
+	if err != nil {
+		return nil
+	}
+
+	var res []PostRevision
+	dbscan.ScanAll(&res, rows)
+	return res
+}
+
+func (r *Repository) PostRevision(ctx context.Context, postID, rev int) *PostRevision {
+	sqlQuery := r.selectQuery("SELECT * FROM post_revision WHERE post_id = ? AND rev = ? LIMIT 1")
+	rows, err := r.db.QueryContext(ctx, sqlQuery, postID, rev)
+	if err != nil {
+		return nil
+	}
+
+	var res PostRevision
+	err = dbscan.ScanOne(&res, rows)
+	if err != nil {
+		return nil
+	}
+	return &res
+}
+
+// CreatePostRevision stores data as the next revision of its post. Callers
+// must hold a lock on the post so revision numbers are not handed out twice.
+func (r *Repository) CreatePostRevision(ctx context.Context, data PostRevision) error {
+	sqlQuery := `INSERT INTO post_revision (post_id, rev, title, content, created_at)
+		SELECT ?, COALESCE(MAX(rev), 0) + 1, ?, ?, ? FROM post_revision WHERE post_id = ?`
+	_, err := r.db.ExecContext(ctx, sqlQuery, data.PostID, data.Title, data.Content, data.CreatedAt, data.PostID)
+	return err
+}
+
+// PublishDuePosts publishes the scheduled posts whose publish time is not
+// after now.
+func (r *Repository) PublishDuePosts(ctx context.Context, now time.Time) (int64, error) {
+	sqlQuery := "UPDATE post SET status = 'published' WHERE status = 'scheduled' AND published_at <= ?"
+	res, err := r.db.ExecContext(ctx, sqlQuery, now)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
 func (r *Repository) DeletePost(ctx context.Context, id int, authorID int) error {
 	sqlQuery := "DELETE FROM post WHERE id = ? AND author_id = ?"
 	_, err := r.db.ExecContext(ctx, sqlQuery, id, authorID)
@@ -176,11 +737,318 @@ func (r *Repository) Comments(ctx context.Context, postID int) []Comment {
 }
 
 func (r *Repository) CreateComment(ctx context.Context, postID int, data Comment) error {
-	sqlQuery := "INSERT INTO comment (post_id, content, author_name) VALUES(?, ?, ?)"
-	_, err := r.db.ExecContext(ctx, sqlQuery, postID, data.Content, data.AuthorName)
+	sqlQuery := "INSERT INTO comment (post_id, author_id, content, author_name) VALUES(?, ?, ?, ?)"
+	_, err := r.db.ExecContext(ctx, sqlQuery, postID, data.AuthorID, data.Content, data.AuthorName)
+	return err
+}
+
+func (r *Repository) DeleteComment(ctx context.Context, id int, postID int) (int64, error) {
+	sqlQuery := "DELETE FROM comment WHERE id = ? AND post_id = ?"
+	res, err := r.db.ExecContext(ctx, sqlQuery, id, postID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (r *Repository) AuthorComments(ctx context.Context, authorID int) []Comment {
+	sqlQuery := r.selectQuery("SELECT * FROM comment WHERE author_id = ? ORDER BY id")
+	rows, err := r.db.QueryContext(ctx, sqlQuery, authorID)
+	if err != nil {
+		return nil
+	}
+
+	var res []Comment
+	dbscan.ScanAll(&res, rows)
+	return res
+}
+
+func (r *Repository) AnonymizeAuthorComments(ctx context.Context, authorID int, name string) error {
+	sqlQuery := "UPDATE comment SET author_id = NULL, author_name = ? WHERE author_id = ?"
+	_, err := r.db.ExecContext(ctx, sqlQuery, name, authorID)
+	return err
+}
+
+func (r *Repository) DeleteAuthorComments(ctx context.Context, authorID int) error {
+	sqlQuery := "DELETE FROM comment WHERE author_id = ?"
+	_, err := r.db.ExecContext(ctx, sqlQuery, authorID)
+	return err
+}
+
+func (r *Repository) Session(ctx context.Context, tokenHash string) *Session {
+	sqlQuery := r.selectQuery("SELECT * FROM session WHERE token_hash = ? LIMIT 1")
+	rows, err := r.db.QueryContext(ctx, sqlQuery, tokenHash)
+	if err != nil {
+		slog.Error("failed to query session", "err", err)
+		return nil
+	}
+
+	var res Session
+	err = dbscan.ScanOne(&res, rows)
+	if err != nil {
+		return nil
+	}
+	return &res
+}
+
+func (r *Repository) CreateSession(ctx context.Context, data Session) error {
+	sqlQuery := `INSERT INTO session (token_hash, id, user_id, ip, user_agent, created_at, last_seen_at, expires_at,
+		idle_expires_at) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err := r.db.ExecContext(ctx, sqlQuery, data.TokenHash, data.ID, data.UserID, data.IP, data.UserAgent,
+		data.CreatedAt, data.LastSeenAt, data.ExpiresAt, data.IdleExpiresAt)
+	return err
+}
+
+// UserSessions returns the sessions of a user still live at now, most
+// recently used first.
+func (r *Repository) UserSessions(ctx context.Context, userID int, now time.Time) ([]Session, error) {
+	sqlQuery := r.selectQuery(`SELECT * FROM session WHERE user_id = ? AND expires_at > ? AND idle_expires_at > ?
+		ORDER BY last_seen_at DESC`)
+	rows, err := r.db.QueryContext(ctx, sqlQuery, userID, now, now)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []Session
+	err = dbscan.ScanAll(&res, rows)
+	return res, err
+}
+
+// TouchSession records the client last using a session and slides its idle
+// expiry, capped at its absolute expiry.
+func (r *Repository) TouchSession(ctx context.Context, tokenHash, ip, userAgent string, lastSeenAt, idleExpiresAt time.Time) error {
+	sqlQuery := `UPDATE session SET ip = ?, user_agent = ?, last_seen_at = ?, idle_expires_at = LEAST(?, expires_at)
+		WHERE token_hash = ?`
+	_, err := r.db.ExecContext(ctx, sqlQuery, ip, userAgent, lastSeenAt, idleExpiresAt, tokenHash)
+	return err
+}
+
+func (r *Repository) DeleteSession(ctx context.Context, tokenHash string) error {
+	sqlQuery := "DELETE FROM session WHERE token_hash = ?"
+	_, err := r.db.ExecContext(ctx, sqlQuery, tokenHash)
+	return err
+}
+
+func (r *Repository) DeleteUserSession(ctx context.Context, userID int, id string) (int64, error) {
+	sqlQuery := "DELETE FROM session WHERE user_id = ? AND id = ?"
+	res, err := r.db.ExecContext(ctx, sqlQuery, userID, id)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (r *Repository) DeleteUserSessions(ctx context.Context, userID int) error {
+	sqlQuery := "DELETE FROM session WHERE user_id = ?"
+	_, err := r.db.ExecContext(ctx, sqlQuery, userID)
+	return err
+}
+
+func (r *Repository) DeleteOtherUserSessions(ctx context.Context, userID int, keepTokenHash string) error {
+	sqlQuery := "DELETE FROM session WHERE user_id = ? AND token_hash <> ?"
+	_, err := r.db.ExecContext(ctx, sqlQuery, userID, keepTokenHash)
+	return err
+}
+
+func (r *Repository) DeleteExpiredSessions(ctx context.Context, now time.Time) (int64, error) {
+	sqlQuery := "DELETE FROM session WHERE expires_at <= ? OR idle_expires_at <= ?"
+	res, err := r.db.ExecContext(ctx, sqlQuery, now, now)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (r *Repository) RefreshToken(ctx context.Context, tokenHash string) *RefreshToken {
+	sqlQuery := r.selectQuery("SELECT * FROM refresh_token WHERE token_hash = ? LIMIT 1")
+	rows, err := r.db.QueryContext(ctx, sqlQuery, tokenHash)
+	if err != nil {
+		slog.Error("failed to query refresh token", "err", err)
+		return nil
+	}
+
+	var res RefreshToken
+	err = dbscan.ScanOne(&res, rows)
+	if err != nil {
+		return nil
+	}
+	return &res
+}
+
+func (r *Repository) CreateRefreshToken(ctx context.Context, data RefreshToken) error {
+	sqlQuery := `INSERT INTO refresh_token (token_hash, family_id, user_id, created_at, expires_at)
+		VALUES(?, ?, ?, ?, ?)`
+	_, err := r.db.ExecContext(ctx, sqlQuery, data.TokenHash, data.FamilyID, data.UserID, data.CreatedAt, data.ExpiresAt)
+	return err
+}
+
+func (r *Repository) MarkRefreshTokenUsed(ctx context.Context, tokenHash string, usedAt time.Time) error {
+	sqlQuery := "UPDATE refresh_token SET used_at = ? WHERE token_hash = ?"
+	_, err := r.db.ExecContext(ctx, sqlQuery, usedAt, tokenHash)
+	return err
+}
+
+func (r *Repository) DeleteRefreshTokenFamily(ctx context.Context, familyID string) error {
+	sqlQuery := "DELETE FROM refresh_token WHERE family_id = ?"
+	_, err := r.db.ExecContext(ctx, sqlQuery, familyID)
+	return err
+}
+
+func (r *Repository) DeleteUserRefreshTokens(ctx context.Context, userID int) error {
+	sqlQuery := "DELETE FROM refresh_token WHERE user_id = ?"
+	_, err := r.db.ExecContext(ctx, sqlQuery, userID)
 	return err
 }
 
+func (r *Repository) DeleteExpiredRefreshTokens(ctx context.Context, now time.Time) (int64, error) {
+	sqlQuery := "DELETE FROM refresh_token WHERE expires_at <= ?"
+	res, err := r.db.ExecContext(ctx, sqlQuery, now)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (r *Repository) PersonalAccessTokenWithHash(ctx context.Context, tokenHash string) *PersonalAccessToken {
+	sqlQuery := r.selectQuery("SELECT * FROM personal_access_token WHERE token_hash = ? LIMIT 1")
+	rows, err := r.db.QueryContext(ctx, sqlQuery, tokenHash)
+	if err != nil {
+		slog.Error("failed to query personal access token", "err", err)
+		return nil
+	}
+
+	var res PersonalAccessToken
+	err = dbscan.ScanOne(&res, rows)
+	if err != nil {
+		return nil
+	}
+	return &res
+}
+
+func (r *Repository) PersonalAccessTokens(ctx context.Context, userID int) []PersonalAccessToken {
+	sqlQuery := r.selectQuery("SELECT * FROM personal_access_token WHERE user_id = ? ORDER BY id")
+	rows, err := r.db.QueryContext(ctx, sqlQuery, userID)
+	if err != nil {
+		return nil
+	}
+
+	var res []PersonalAccessToken
+	dbscan.ScanAll(&res, rows)
+	return res
+}
+
+func (r *Repository) CreatePersonalAccessToken(ctx context.Context, data PersonalAccessToken) (int, error) {
+	sqlQuery := `INSERT INTO personal_access_token (user_id, name, token_hash, scopes, expires_at)
+		VALUES(?, ?, ?, ?, ?)`
+	res, err := r.db.ExecContext(ctx, sqlQuery, data.UserID, data.Name, data.TokenHash, data.Scopes, data.ExpiresAt)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := res.LastInsertId()
+	return int(id), err
+}
+
+func (r *Repository) TouchPersonalAccessToken(ctx context.Context, id int, lastUsedAt time.Time) error {
+	sqlQuery := "UPDATE personal_access_token SET last_used_at = ? WHERE id = ?"
+	_, err := r.db.ExecContext(ctx, sqlQuery, lastUsedAt, id)
+	return err
+}
+
+func (r *Repository) DeletePersonalAccessToken(ctx context.Context, id int, userID int) (int64, error) {
+	sqlQuery := "DELETE FROM personal_access_token WHERE id = ? AND user_id = ?"
+	res, err := r.db.ExecContext(ctx, sqlQuery, id, userID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (r *Repository) DeleteUserPersonalAccessTokens(ctx context.Context, userID int) error {
+	sqlQuery := "DELETE FROM personal_access_token WHERE user_id = ?"
+	_, err := r.db.ExecContext(ctx, sqlQuery, userID)
+	return err
+}
+
+func (r *Repository) WebAuthnCredentialWithID(ctx context.Context, credentialID []byte) *WebAuthnCredential {
+	sqlQuery := r.selectQuery("SELECT * FROM webauthn_credential WHERE credential_id = ? LIMIT 1")
+	rows, err := r.db.QueryContext(ctx, sqlQuery, credentialID)
+	if err != nil {
+		slog.Error("failed to query webauthn credential", "err", err)
+		return nil
+	}
+
+	var res WebAuthnCredential
+	err = dbscan.ScanOne(&res, rows)
+	if err != nil {
+		return nil
+	}
+	return &res
+}
+
+func (r *Repository) WebAuthnCredentials(ctx context.Context, userID int) []WebAuthnCredential {
+	sqlQuery := r.selectQuery("SELECT * FROM webauthn_credential WHERE user_id = ? ORDER BY id")
+	rows, err := r.db.QueryContext(ctx, sqlQuery, userID)
+	if err != nil {
+		return nil
+	}
+
+	var res []WebAuthnCredential
+	dbscan.ScanAll(&res, rows)
+	return res
+}
+
+func (r *Repository) CreateWebAuthnCredential(ctx context.Context, data WebAuthnCredential) (int, error) {
+	sqlQuery := `INSERT INTO webauthn_credential (user_id, name, credential_id, public_key, sign_count, created_at)
+		VALUES(?, ?, ?, ?, ?, ?)`
+	res, err := r.db.ExecContext(ctx, sqlQuery, data.UserID, data.Name, data.CredentialID, data.PublicKey,
+		data.SignCount, data.CreatedAt)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := res.LastInsertId()
+	return int(id), err
+}
+
+func (r *Repository) UpdateWebAuthnCredentialUse(ctx context.Context, id int, signCount uint32, lastUsedAt time.Time) error {
+	sqlQuery := "UPDATE webauthn_credential SET sign_count = ?, last_used_at = ? WHERE id = ?"
+	_, err := r.db.ExecContext(ctx, sqlQuery, signCount, lastUsedAt, id)
+	return err
+}
+
+func (r *Repository) DeleteWebAuthnCredential(ctx context.Context, id int, userID int) (int64, error) {
+	sqlQuery := "DELETE FROM webauthn_credential WHERE id = ? AND user_id = ?"
+	res, err := r.db.ExecContext(ctx, sqlQuery, id, userID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (r *Repository) DeleteUserWebAuthnCredentials(ctx context.Context, userID int) error {
+	sqlQuery := "DELETE FROM webauthn_credential WHERE user_id = ?"
+	_, err := r.db.ExecContext(ctx, sqlQuery, userID)
+	return err
+}
+
+// UseWebAuthnChallenge records the challenge with id as used. A second use
+// fails with a duplicate key error.
+func (r *Repository) UseWebAuthnChallenge(ctx context.Context, id string, expiresAt time.Time) error {
+	sqlQuery := "INSERT INTO webauthn_challenge (id, expires_at) VALUES(?, ?)"
+	_, err := r.db.ExecContext(ctx, sqlQuery, id, expiresAt)
+	return err
+}
+
+func (r *Repository) DeleteExpiredWebAuthnChallenges(ctx context.Context, now time.Time) error {
+	sqlQuery := "DELETE FROM webauthn_challenge WHERE expires_at <= ?"
+	_, err := r.db.ExecContext(ctx, sqlQuery, now)
+	return err
+}
+
+// likeEscaper escapes the wildcards of a LIKE pattern.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
 func (r *Repository) selectQuery(query string) string {
 	if r.ForUpdate {
 		query += " FOR UPDATE"
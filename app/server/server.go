@@ -2,8 +2,13 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"log/slog"
+	"net"
 	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
 	"time"
 )
 
@@ -16,15 +21,33 @@ func New(mux *http.ServeMux, addr string) *http.Server {
 	}
 }
 
+// FieldErrors reports invalid input per request field.
+type FieldErrors map[string]string
+
+func (e FieldErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for field, msg := range e {
+		msgs = append(msgs, field+" "+msg)
+	}
+	slices.Sort(msgs)
+	return "invalid input: " + strings.Join(msgs, "; ")
+}
+
 func ErrorResponse(w http.ResponseWriter, code int, err error) {
 	slog.Error("Error response", "err", err, "code", code)
 	w.WriteHeader(code)
 	output := struct {
-		Error string `json:"error"`
+		Error  string            `json:"error"`
+		Fields map[string]string `json:"fields,omitempty"`
 	}{
 		Error: err.Error(),
 	}
 
+	var fields FieldErrors
+	if errors.As(err, &fields) {
+		output.Fields = fields
+	}
+
 	err = json.NewEncoder(w).Encode(output)
 	if err != nil {
 		slog.Error("Failed writing error response", "err", err)
@@ -38,3 +61,78 @@ func JSONResponse(w http.ResponseWriter, code int, data any) {
 		slog.Error("Failed writing response", "err", err, "data", data)
 	}
 }
+
+// ClientIP returns the IP address of the peer that sent r. Behind
+// TrustProxies that is the client the proxies forwarded the request for.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// TrustProxies makes ClientIP see through the reverse proxies in trusted.
+// When a request arrives from a trusted address, X-Forwarded-For is walked
+// from the right and the first hop outside trusted becomes r.RemoteAddr.
+// Requests from anywhere else keep their peer address, so clients cannot
+// pick their own IP by sending the header.
+func TrustProxies(trusted []netip.Prefix, next http.Handler) http.Handler {
+	if len(trusted) == 0 {
+		return next
+	}
+	isTrusted := func(addr netip.Addr) bool {
+		return slices.ContainsFunc(trusted, func(p netip.Prefix) bool { return p.Contains(addr) })
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peer, err := netip.ParseAddr(ClientIP(r))
+		if err != nil || !isTrusted(peer.Unmap()) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		client := peer.Unmap()
+		hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+			if err != nil {
+				break
+			}
+			client = addr.Unmap()
+			if !isTrusted(client) {
+				break
+			}
+		}
+
+		r = r.Clone(r.Context())
+		r.RemoteAddr = client.String()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ParsePrefixes parses a comma separated list of CIDRs and bare IPs, the
+// latter standing for a single address.
+func ParsePrefixes(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !strings.Contains(field, "/") {
+			addr, err := netip.ParseAddr(field)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(field)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
@@ -0,0 +1,265 @@
+package session
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps sessions in process memory. Sessions are lost on restart,
+// so it is meant for tests and single instance development setups.
+type MemoryStore struct {
+	cfg      Config
+	m        sync.Mutex
+	sessions map[string]Session
+}
+
+func NewMemoryStore(cfg Config) *MemoryStore {
+	return &MemoryStore{cfg: cfg, sessions: make(map[string]Session)}
+}
+
+func (s *MemoryStore) Create(ctx context.Context, userID int, client Client) (Session, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	for range maxCreateAttempts {
+		sess, err := newSession(userID, client, s.cfg, time.Now())
+		if err != nil {
+			return Session{}, err
+		}
+
+		key := HashToken(sess.Token)
+		if _, ok := s.sessions[key]; ok {
+			continue
+		}
+
+		stored := sess
+		stored.Token = ""
+		s.sessions[key] = stored
+		return sess, nil
+	}
+	return Session{}, ErrCollision
+}
+
+func (s *MemoryStore) Get(ctx context.Context, token string) (Session, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	key := HashToken(token)
+	sess, ok := s.sessions[key]
+	if !ok {
+		return Session{}, ErrNotFound
+	}
+	if sess.Expired(time.Now()) {
+		delete(s.sessions, key)
+		return Session{}, ErrExpired
+	}
+
+	sess.Token = token
+	return sess, nil
+}
+
+func (s *MemoryStore) List(ctx context.Context, userID int) ([]Session, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	now := time.Now()
+	var res []Session
+	for _, sess := range s.sessions {
+		if sess.UserID == userID && !sess.Expired(now) {
+			res = append(res, sess)
+		}
+	}
+	slices.SortFunc(res, func(a, b Session) int {
+		return b.LastSeenAt.Compare(a.LastSeenAt)
+	})
+	return res, nil
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, token string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	delete(s.sessions, HashToken(token))
+	return nil
+}
+
+func (s *MemoryStore) DeleteByID(ctx context.Context, userID int, id string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	for key, sess := range s.sessions {
+		if sess.UserID == userID && sess.ID == id {
+			delete(s.sessions, key)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (s *MemoryStore) DeleteByUser(ctx context.Context, userID int) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	for key, sess := range s.sessions {
+		if sess.UserID == userID {
+			delete(s.sessions, key)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) DeleteOthers(ctx context.Context, userID int, keepToken string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	keep := HashToken(keepToken)
+	for key, sess := range s.sessions {
+		if sess.UserID == userID && key != keep {
+			delete(s.sessions, key)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) Touch(ctx context.Context, token string, client Client) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	key := HashToken(token)
+	sess, ok := s.sessions[key]
+	if !ok {
+		return ErrNotFound
+	}
+
+	now := time.Now()
+	client = client.normalize()
+	sess.IP = client.IP
+	sess.UserAgent = client.UserAgent
+	sess.LastSeenAt = now
+	sess.IdleExpiresAt = idleExpiry(now, sess.ExpiresAt, s.cfg)
+	s.sessions[key] = sess
+	return nil
+}
+
+func (s *MemoryStore) DeleteExpired(ctx context.Context, now time.Time) (int, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	var n int
+	for key, sess := range s.sessions {
+		if sess.Expired(now) {
+			delete(s.sessions, key)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// MemoryRefreshStore is the in-memory counterpart of MySQLRefreshStore.
+type MemoryRefreshStore struct {
+	cfg    Config
+	m      sync.Mutex
+	tokens map[string]RefreshToken
+}
+
+func NewMemoryRefreshStore(cfg Config) *MemoryRefreshStore {
+	return &MemoryRefreshStore{cfg: cfg, tokens: make(map[string]RefreshToken)}
+}
+
+func (s *MemoryRefreshStore) Create(ctx context.Context, userID int) (RefreshToken, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return s.create(userID, "")
+}
+
+func (s *MemoryRefreshStore) create(userID int, familyID string) (RefreshToken, error) {
+	for range maxCreateAttempts {
+		rt, err := newRefreshToken(userID, familyID, s.cfg, time.Now())
+		if err != nil {
+			return RefreshToken{}, err
+		}
+
+		key := HashToken(rt.Token)
+		if _, ok := s.tokens[key]; ok {
+			continue
+		}
+
+		stored := rt
+		stored.Token = ""
+		s.tokens[key] = stored
+		return rt, nil
+	}
+	return RefreshToken{}, ErrCollision
+}
+
+func (s *MemoryRefreshStore) Rotate(ctx context.Context, token string) (RefreshToken, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	key := HashToken(token)
+	rt, ok := s.tokens[key]
+	if !ok {
+		return RefreshToken{}, ErrNotFound
+	}
+	if rt.UsedAt != nil {
+		s.deleteFamily(rt.FamilyID)
+		return RefreshToken{}, ErrRefreshReused
+	}
+
+	now := time.Now()
+	if !now.Before(rt.ExpiresAt) {
+		return RefreshToken{}, ErrExpired
+	}
+
+	rt.UsedAt = &now
+	s.tokens[key] = rt
+	return s.create(rt.UserID, rt.FamilyID)
+}
+
+func (s *MemoryRefreshStore) Delete(ctx context.Context, token string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	rt, ok := s.tokens[HashToken(token)]
+	if ok {
+		s.deleteFamily(rt.FamilyID)
+	}
+	return nil
+}
+
+func (s *MemoryRefreshStore) DeleteByUser(ctx context.Context, userID int) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	for key, rt := range s.tokens {
+		if rt.UserID == userID {
+			delete(s.tokens, key)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryRefreshStore) DeleteExpired(ctx context.Context, now time.Time) (int, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	var n int
+	for key, rt := range s.tokens {
+		if !now.Before(rt.ExpiresAt) {
+			delete(s.tokens, key)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *MemoryRefreshStore) deleteFamily(familyID string) {
+	for key, rt := range s.tokens {
+		if rt.FamilyID == familyID {
+			delete(s.tokens, key)
+		}
+	}
+}
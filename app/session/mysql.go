@@ -0,0 +1,258 @@
+package session
+
+import (
+	"app/repository"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// MySQLStore keeps sessions in the session table so they survive restarts
+// and can be shared by several app instances.
+type MySQLStore struct {
+	db  *sql.DB
+	cfg Config
+}
+
+func NewMySQLStore(db *sql.DB, cfg Config) *MySQLStore {
+	return &MySQLStore{db: db, cfg: cfg}
+}
+
+func (s *MySQLStore) Create(ctx context.Context, userID int, client Client) (Session, error) {
+	repo := repository.New(s.db)
+
+	for range maxCreateAttempts {
+		sess, err := newSession(userID, client, s.cfg, time.Now())
+		if err != nil {
+			return Session{}, err
+		}
+
+		err = repo.CreateSession(ctx, mapSessionStoreToRepo(sess))
+		if repository.IsDuplicate(err) {
+			continue
+		}
+		if err != nil {
+			return Session{}, err
+		}
+		return sess, nil
+	}
+	return Session{}, ErrCollision
+}
+
+func (s *MySQLStore) Get(ctx context.Context, token string) (Session, error) {
+	repo := repository.New(s.db)
+	data := repo.Session(ctx, HashToken(token))
+	if data == nil {
+		return Session{}, ErrNotFound
+	}
+
+	sess := mapSessionRepoToStore(*data)
+	if sess.Expired(time.Now()) {
+		return Session{}, ErrExpired
+	}
+
+	sess.Token = token
+	return sess, nil
+}
+
+func (s *MySQLStore) List(ctx context.Context, userID int) ([]Session, error) {
+	repo := repository.New(s.db)
+	data, err := repo.UserSessions(ctx, userID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]Session, 0, len(data))
+	for _, d := range data {
+		res = append(res, mapSessionRepoToStore(d))
+	}
+	return res, nil
+}
+
+func (s *MySQLStore) Delete(ctx context.Context, token string) error {
+	repo := repository.New(s.db)
+	return repo.DeleteSession(ctx, HashToken(token))
+}
+
+func (s *MySQLStore) DeleteByID(ctx context.Context, userID int, id string) error {
+	repo := repository.New(s.db)
+	n, err := repo.DeleteUserSession(ctx, userID, id)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *MySQLStore) DeleteByUser(ctx context.Context, userID int) error {
+	repo := repository.New(s.db)
+	return repo.DeleteUserSessions(ctx, userID)
+}
+
+func (s *MySQLStore) DeleteOthers(ctx context.Context, userID int, keepToken string) error {
+	repo := repository.New(s.db)
+	return repo.DeleteOtherUserSessions(ctx, userID, HashToken(keepToken))
+}
+
+func (s *MySQLStore) Touch(ctx context.Context, token string, client Client) error {
+	repo := repository.New(s.db)
+	now := time.Now()
+	client = client.normalize()
+	return repo.TouchSession(ctx, HashToken(token), client.IP, client.UserAgent, now, now.Add(s.cfg.IdleTimeout))
+}
+
+func (s *MySQLStore) DeleteExpired(ctx context.Context, now time.Time) (int, error) {
+	repo := repository.New(s.db)
+	n, err := repo.DeleteExpiredSessions(ctx, now)
+	return int(n), err
+}
+
+func mapSessionRepoToStore(data repository.Session) Session {
+	return Session{
+		ID:            data.ID,
+		UserID:        data.UserID,
+		IP:            data.IP,
+		UserAgent:     data.UserAgent,
+		CreatedAt:     data.CreatedAt,
+		LastSeenAt:    data.LastSeenAt,
+		ExpiresAt:     data.ExpiresAt,
+		IdleExpiresAt: data.IdleExpiresAt,
+	}
+}
+
+func mapSessionStoreToRepo(data Session) repository.Session {
+	return repository.Session{
+		TokenHash:     HashToken(data.Token),
+		ID:            data.ID,
+		UserID:        data.UserID,
+		IP:            data.IP,
+		UserAgent:     data.UserAgent,
+		CreatedAt:     data.CreatedAt,
+		LastSeenAt:    data.LastSeenAt,
+		ExpiresAt:     data.ExpiresAt,
+		IdleExpiresAt: data.IdleExpiresAt,
+	}
+}
+
+// MySQLRefreshStore keeps refresh tokens in the refresh_token table. Rotated
+// tokens stay in the table, marked used, until they expire so that a replay
+// can be detected.
+type MySQLRefreshStore struct {
+	db  *sql.DB
+	cfg Config
+}
+
+func NewMySQLRefreshStore(db *sql.DB, cfg Config) *MySQLRefreshStore {
+	return &MySQLRefreshStore{db: db, cfg: cfg}
+}
+
+func (s *MySQLRefreshStore) Create(ctx context.Context, userID int) (RefreshToken, error) {
+	return s.create(ctx, repository.New(s.db), userID, "")
+}
+
+func (s *MySQLRefreshStore) create(ctx context.Context, repo *repository.Repository, userID int, familyID string) (RefreshToken, error) {
+	for range maxCreateAttempts {
+		rt, err := newRefreshToken(userID, familyID, s.cfg, time.Now())
+		if err != nil {
+			return RefreshToken{}, err
+		}
+
+		err = repo.CreateRefreshToken(ctx, repository.RefreshToken{
+			TokenHash: HashToken(rt.Token),
+			FamilyID:  rt.FamilyID,
+			UserID:    rt.UserID,
+			CreatedAt: rt.CreatedAt,
+			ExpiresAt: rt.ExpiresAt,
+		})
+		if repository.IsDuplicate(err) {
+			continue
+		}
+		if err != nil {
+			return RefreshToken{}, err
+		}
+		return rt, nil
+	}
+	return RefreshToken{}, ErrCollision
+}
+
+func (s *MySQLRefreshStore) Rotate(ctx context.Context, token string) (RefreshToken, error) {
+	var res RefreshToken
+	var reused *repository.RefreshToken
+
+	err := s.execInTx(ctx, func(r *repository.Repository) error {
+		rt := r.RefreshToken(ctx, HashToken(token))
+		if rt == nil {
+			return ErrNotFound
+		}
+		if rt.UsedAt != nil {
+			reused = rt
+			return ErrRefreshReused
+		}
+
+		now := time.Now()
+		if !now.Before(rt.ExpiresAt) {
+			return ErrExpired
+		}
+
+		err := r.MarkRefreshTokenUsed(ctx, rt.TokenHash, now)
+		if err != nil {
+			return err
+		}
+
+		res, err = s.create(ctx, r, rt.UserID, rt.FamilyID)
+		return err
+	})
+
+	// The family is revoked outside of the rolled back transaction so the
+	// revocation sticks.
+	if reused != nil {
+		repo := repository.New(s.db)
+		if delErr := repo.DeleteRefreshTokenFamily(ctx, reused.FamilyID); delErr != nil {
+			return RefreshToken{}, errors.Join(err, delErr)
+		}
+	}
+	return res, err
+}
+
+func (s *MySQLRefreshStore) Delete(ctx context.Context, token string) error {
+	repo := repository.New(s.db)
+	rt := repo.RefreshToken(ctx, HashToken(token))
+	if rt == nil {
+		return nil
+	}
+	return repo.DeleteRefreshTokenFamily(ctx, rt.FamilyID)
+}
+
+func (s *MySQLRefreshStore) DeleteByUser(ctx context.Context, userID int) error {
+	repo := repository.New(s.db)
+	return repo.DeleteUserRefreshTokens(ctx, userID)
+}
+
+func (s *MySQLRefreshStore) DeleteExpired(ctx context.Context, now time.Time) (int, error) {
+	repo := repository.New(s.db)
+	n, err := repo.DeleteExpiredRefreshTokens(ctx, now)
+	return int(n), err
+}
+
+func (s *MySQLRefreshStore) execInTx(ctx context.Context, fn func(*repository.Repository) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	repo := repository.New(tx)
+	repo.ForUpdate = true
+	err = fn(repo)
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return fmt.Errorf("tx err: %v, rb err: %v", err, rbErr)
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,57 @@
+package session
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// ErrRefreshReused is returned when a refresh token that was already rotated
+// is presented again. The whole token family is revoked when it happens since
+// either the client or an attacker holds a stolen copy.
+var ErrRefreshReused = errors.New("refresh token reused")
+
+// RefreshToken is a long lived token exchanged for new access tokens. Each
+// exchange rotates it: the presented token is marked used and a successor in
+// the same family is issued.
+type RefreshToken struct {
+	Token     string
+	FamilyID  string
+	UserID    int
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
+
+type RefreshStore interface {
+	Create(ctx context.Context, userID int) (RefreshToken, error)
+	Rotate(ctx context.Context, token string) (RefreshToken, error)
+	Delete(ctx context.Context, token string) error
+	DeleteByUser(ctx context.Context, userID int) error
+	DeleteExpired(ctx context.Context, now time.Time) (int, error)
+}
+
+func newRefreshToken(userID int, familyID string, cfg Config, now time.Time) (RefreshToken, error) {
+	token, err := NewToken()
+	if err != nil {
+		return RefreshToken{}, err
+	}
+
+	if familyID == "" {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return RefreshToken{}, err
+		}
+		familyID = hex.EncodeToString(b)
+	}
+
+	return RefreshToken{
+		Token:     token,
+		FamilyID:  familyID,
+		UserID:    userID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(cfg.RefreshLifetime),
+	}, nil
+}
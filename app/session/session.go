@@ -1,43 +1,175 @@
 package session
 
 import (
-	"math/rand/v2"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log/slog"
 	"strings"
-	"sync"
+	"time"
 )
 
 var (
-	m            sync.Mutex
-	sessionStore map[string]int = make(map[string]int)
+	ErrNotFound  = errors.New("session not found")
+	ErrExpired   = errors.New("session expired")
+	ErrCollision = errors.New("session token collision")
 )
 
-func Create(id int) string {
-	m.Lock()
-	defer m.Unlock()
+// maxUserAgentLength caps the stored user agent, clients control it.
+const maxUserAgentLength = 512
 
-	key := generate(8)
-	if _, ok := sessionStore[key]; !ok {
-		sessionStore[key] = id
+// maxCreateAttempts bounds how many fresh tokens Create tries before giving
+// up on a collision. With 256 bit tokens a single retry is already absurdly
+// unlikely.
+const maxCreateAttempts = 3
+
+// Session is a login session. Token is the secret handed to the client and is
+// only known right after Create or when the caller supplied it to Get; stores
+// index sessions by the SHA-256 hash of the token and never persist the token
+// itself. ID is a public handle that lets the user refer to the session
+// without knowing its token.
+type Session struct {
+	Token         string
+	ID            string
+	UserID        int
+	IP            string
+	UserAgent     string
+	CreatedAt     time.Time
+	LastSeenAt    time.Time
+	ExpiresAt     time.Time
+	IdleExpiresAt time.Time
+}
+
+func (s Session) Expired(now time.Time) bool {
+	return !now.Before(s.ExpiresAt) || !now.Before(s.IdleExpiresAt)
+}
+
+// Client describes the device a session is used from.
+type Client struct {
+	IP        string
+	UserAgent string
+}
+
+func (c Client) normalize() Client {
+	if len(c.UserAgent) > maxUserAgentLength {
+		c.UserAgent = strings.ToValidUTF8(c.UserAgent[:maxUserAgentLength], "")
+	}
+	return c
+}
+
+// Config controls how long a session lives. Lifetime is the absolute limit
+// counted from login, IdleTimeout is extended every time the session is
+// touched but never past the absolute limit. RefreshLifetime applies to
+// refresh tokens and restarts on every rotation.
+type Config struct {
+	Lifetime        time.Duration
+	IdleTimeout     time.Duration
+	RefreshLifetime time.Duration
+}
+
+var DefaultConfig = Config{
+	Lifetime:        7 * 24 * time.Hour,
+	IdleTimeout:     24 * time.Hour,
+	RefreshLifetime: 30 * 24 * time.Hour,
+}
+
+// Store persists login sessions. Implementations must be safe for concurrent
+// use so a single store can be shared by every handler.
+type Store interface {
+	Create(ctx context.Context, userID int, client Client) (Session, error)
+	Get(ctx context.Context, token string) (Session, error)
+	// List returns the live sessions of the user, most recently used
+	// first.
+	List(ctx context.Context, userID int) ([]Session, error)
+	Delete(ctx context.Context, token string) error
+	// DeleteByID deletes the session of the user with the public id,
+	// returning ErrNotFound if there is none.
+	DeleteByID(ctx context.Context, userID int, id string) error
+	DeleteByUser(ctx context.Context, userID int) error
+	// DeleteOthers deletes every session of the user except the one for
+	// keepToken.
+	DeleteOthers(ctx context.Context, userID int, keepToken string) error
+	// Touch records that the session was just used by client and slides
+	// its idle expiry.
+	Touch(ctx context.Context, token string, client Client) error
+	DeleteExpired(ctx context.Context, now time.Time) (int, error)
+}
+
+type Expirer interface {
+	DeleteExpired(ctx context.Context, now time.Time) (int, error)
+}
+
+// Sweep periodically evicts expired entries from the store until ctx is
+// cancelled.
+func Sweep(ctx context.Context, store Expirer, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			n, err := store.DeleteExpired(ctx, now)
+			if err != nil {
+				slog.Error("failed to sweep expired entries", "err", err)
+				continue
+			}
+			if n > 0 {
+				slog.Info("swept expired entries", "count", n)
+			}
+		}
 	}
-	return key
 }
 
-func Get(token string) (int, bool) {
-	m.Lock()
-	defer m.Unlock()
+func newSession(userID int, client Client, cfg Config, now time.Time) (Session, error) {
+	token, err := NewToken()
+	if err != nil {
+		return Session{}, err
+	}
 
-	v, ok := sessionStore[token]
-	return v, ok
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return Session{}, err
+	}
+
+	client = client.normalize()
+	return Session{
+		Token:         token,
+		ID:            hex.EncodeToString(id),
+		UserID:        userID,
+		IP:            client.IP,
+		UserAgent:     client.UserAgent,
+		CreatedAt:     now,
+		LastSeenAt:    now,
+		ExpiresAt:     now.Add(cfg.Lifetime),
+		IdleExpiresAt: idleExpiry(now, now.Add(cfg.Lifetime), cfg),
+	}, nil
 }
 
-func generate(n int) string {
-	chars := "0123456789abcdefghijklmnopqrstuvwxyz"
-	var sb strings.Builder
-	sb.Grow(n)
+func idleExpiry(now, expiresAt time.Time, cfg Config) time.Time {
+	t := now.Add(cfg.IdleTimeout)
+	if t.After(expiresAt) {
+		return expiresAt
+	}
+	return t
+}
 
-	for i := 0; i < n; i++ {
-		idx := rand.IntN(len(chars))
-		sb.WriteByte(chars[idx])
+// NewToken returns a random 256 bit token encoded as URL safe base64.
+func NewToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
 	}
-	return sb.String()
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashToken returns the hex encoded SHA-256 of token, the form tokens are
+// stored in.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
 }
@@ -0,0 +1,145 @@
+package throttle
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Config shapes the penalty for failed attempts. The first FreeAttempts
+// failures cost nothing, every later failure blocks the key for BaseDelay
+// doubled per extra failure up to MaxDelay, and reaching LockoutAfter
+// failures locks the key for LockoutDuration. Failures are forgotten once a
+// key has been quiet for ForgetAfter.
+type Config struct {
+	FreeAttempts    int
+	BaseDelay       time.Duration
+	MaxDelay        time.Duration
+	LockoutAfter    int
+	LockoutDuration time.Duration
+	ForgetAfter     time.Duration
+}
+
+type entry struct {
+	failures     int
+	blockedUntil time.Time
+	lastFailure  time.Time
+}
+
+// Limiter tracks failed attempts per key in memory. Each app instance keeps
+// its own counts, so limits are only enforced as configured when a single
+// instance runs; N instances behind a round robin balancer allow up to N
+// times as many attempts.
+type Limiter struct {
+	cfg     Config
+	m       sync.Mutex
+	entries map[string]*entry
+}
+
+func New(cfg Config) *Limiter {
+	return &Limiter{cfg: cfg, entries: make(map[string]*entry)}
+}
+
+// Allow reports whether key may attempt now, and if not, how long until it
+// may.
+func (l *Limiter) Allow(key string, now time.Time) (time.Duration, bool) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	e, ok := l.entries[key]
+	if !ok || !now.Before(e.blockedUntil) {
+		return 0, true
+	}
+	return e.blockedUntil.Sub(now), false
+}
+
+// Attempt is Allow followed by Fail in one step: an allowed attempt is
+// counted as failed right away, before the caller gets to check it. That way
+// a burst of parallel attempts cannot all pass before the first failure is
+// recorded. Attempts that turn out to succeed are handed back with Refund or
+// Reset.
+func (l *Limiter) Attempt(key string, now time.Time) (time.Duration, bool) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	e, ok := l.entries[key]
+	if ok && now.Before(e.blockedUntil) {
+		return e.blockedUntil.Sub(now), false
+	}
+	l.fail(key, now)
+	return 0, true
+}
+
+// Refund takes back one attempt counted by Attempt. The block it may have
+// caused is lifted once the remaining failures are free again.
+func (l *Limiter) Refund(key string) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	e, ok := l.entries[key]
+	if !ok || e.failures == 0 {
+		return
+	}
+
+	e.failures--
+	if e.failures <= l.cfg.FreeAttempts {
+		e.blockedUntil = time.Time{}
+	}
+}
+
+// Fail records a failed attempt for key.
+func (l *Limiter) Fail(key string, now time.Time) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	l.fail(key, now)
+}
+
+func (l *Limiter) fail(key string, now time.Time) {
+	e, ok := l.entries[key]
+	if !ok || l.forgotten(e, now) {
+		e = &entry{}
+		l.entries[key] = e
+	}
+
+	e.failures++
+	e.lastFailure = now
+
+	switch {
+	case l.cfg.LockoutAfter > 0 && e.failures >= l.cfg.LockoutAfter:
+		e.blockedUntil = now.Add(l.cfg.LockoutDuration)
+	case e.failures > l.cfg.FreeAttempts:
+		delay := l.cfg.BaseDelay << (e.failures - l.cfg.FreeAttempts - 1)
+		if delay <= 0 || delay > l.cfg.MaxDelay {
+			delay = l.cfg.MaxDelay
+		}
+		e.blockedUntil = now.Add(delay)
+	}
+}
+
+// Reset forgets the failures of key, typically after a successful attempt.
+func (l *Limiter) Reset(key string) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	delete(l.entries, key)
+}
+
+// DeleteExpired drops keys that are neither blocked nor remembered anymore.
+func (l *Limiter) DeleteExpired(ctx context.Context, now time.Time) (int, error) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	var n int
+	for key, e := range l.entries {
+		if l.forgotten(e, now) {
+			delete(l.entries, key)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (l *Limiter) forgotten(e *entry, now time.Time) bool {
+	return !now.Before(e.blockedUntil) && now.Sub(e.lastFailure) >= l.cfg.ForgetAfter
+}
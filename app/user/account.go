@@ -0,0 +1,218 @@
+package user
+
+import (
+	"app/repository"
+	"app/server"
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// DeletionMode decides what DELETE /me does with an account.
+type DeletionMode string
+
+const (
+	// DeleteHard removes the user together with their posts and comments.
+	DeleteHard DeletionMode = "delete"
+	// DeleteAnonymize strips every personal detail from the user but keeps
+	// their posts and comments under a placeholder name.
+	DeleteAnonymize DeletionMode = "anonymize"
+)
+
+const anonymousName = "Deleted user"
+
+type Export struct {
+	Profile  Profile         `json:"profile"`
+	Posts    []ExportPost    `json:"posts"`
+	Comments []ExportComment `json:"comments"`
+}
+
+type ExportPost struct {
+	ID          int        `json:"id"`
+	Title       string     `json:"title"`
+	Content     string     `json:"content"`
+	Status      string     `json:"status"`
+	PublishedAt *time.Time `json:"published_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
+
+type ExportComment struct {
+	ID         int       `json:"id"`
+	PostID     int       `json:"post_id"`
+	AuthorName string    `json:"author_name"`
+	Content    string    `json:"content"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+func (s *Service) ExportHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := IDFromContext(r.Context())
+		export := s.Export(r.Context(), userID)
+		if export == nil {
+			server.ErrorResponse(w, http.StatusNotFound, ErrNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="export-%d.zip"`, userID))
+		w.WriteHeader(http.StatusOK)
+
+		// The status is already sent, a failure can only be logged.
+		err := writeExport(w, export)
+		if err != nil {
+			slog.Error("failed to write export", "user_id", userID, "err", err)
+		}
+	}
+}
+
+// Export collects the personal data held about the user.
+func (s *Service) Export(ctx context.Context, userID int) *Export {
+	repo := repository.New(s.db)
+	u := repo.User(ctx, userID)
+	if u == nil {
+		return nil
+	}
+
+	res := Export{
+		Profile:  mapProfileRepoToService(*u),
+		Posts:    []ExportPost{},
+		Comments: []ExportComment{},
+	}
+	for _, p := range repo.AuthorPosts(ctx, userID) {
+		res.Posts = append(res.Posts, ExportPost{
+			ID:          p.ID,
+			Title:       p.Title,
+			Content:     p.Content,
+			Status:      p.Status,
+			PublishedAt: p.PublishedAt,
+			CreatedAt:   p.CreatedAt,
+			UpdatedAt:   p.UpdatedAt,
+		})
+	}
+	for _, c := range repo.AuthorComments(ctx, userID) {
+		res.Comments = append(res.Comments, ExportComment{
+			ID:         c.ID,
+			PostID:     c.PostID,
+			AuthorName: c.AuthorName,
+			Content:    c.Content,
+			CreatedAt:  c.CreatedAt,
+		})
+	}
+	return &res
+}
+
+// writeExport streams export as a ZIP archive with one JSON file per kind of
+// data.
+func writeExport(w io.Writer, export *Export) error {
+	zw := zip.NewWriter(w)
+	files := []struct {
+		name string
+		data any
+	}{
+		{"profile.json", export.Profile},
+		{"posts.json", export.Posts},
+		{"comments.json", export.Comments},
+	}
+	for _, f := range files {
+		fw, err := zw.Create(f.name)
+		if err != nil {
+			return err
+		}
+
+		enc := json.NewEncoder(fw)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(f.data)
+		if err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func (s *Service) DeleteAccountHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input struct {
+			CurrentPassword  string `json:"current_password"`
+			ConfirmationCode string `json:"confirmation_code"`
+		}
+
+		err := json.NewDecoder(r.Body).Decode(&input)
+		if err != nil {
+			server.ErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		err = s.DeleteAccount(r.Context(), IDFromContext(r.Context()),
+			input.CurrentPassword, input.ConfirmationCode, server.ClientIP(r))
+		if err != nil {
+			writeCredentialsError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// DeleteAccount removes or anonymizes the account according to the
+// configured DeletionMode and signs the user out everywhere. The user
+// confirms with their current password or, without one, with a code from
+// SendConfirmationCode.
+func (s *Service) DeleteAccount(ctx context.Context, userID int, currentPassword, confirmationCode, ip string) error {
+	err := s.confirmUser(ctx, userID, currentPassword, confirmationCode, ip)
+	if err != nil {
+		return err
+	}
+
+	err = s.execInTx(ctx, func(r *repository.Repository) error {
+		if s.deletionMode == DeleteAnonymize {
+			return anonymizeUser(ctx, r, userID)
+		}
+
+		// Posts and everything else keyed by the user go with the
+		// cascade, comments only lose their author so they are removed
+		// explicitly.
+		err := r.DeleteAuthorComments(ctx, userID)
+		if err != nil {
+			return err
+		}
+		return r.DeleteUser(ctx, userID)
+	})
+	if err != nil {
+		return fmt.Errorf("unable to delete user %d: %w", userID, err)
+	}
+
+	return s.RevokeAllSessions(ctx, userID)
+}
+
+func anonymizeUser(ctx context.Context, r *repository.Repository, userID int) error {
+	err := r.AnonymizeUser(ctx, userID, anonymousName, fmt.Sprintf("deleted-%d@invalid", userID))
+	if err != nil {
+		return err
+	}
+
+	err = r.AnonymizeAuthorComments(ctx, userID, anonymousName)
+	if err != nil {
+		return err
+	}
+
+	deletes := []func(context.Context, int) error{
+		r.DeleteUserIdentities,
+		r.DeleteRecoveryCodes,
+		r.DeleteAllUserTokens,
+		r.DeleteUserPersonalAccessTokens,
+		r.DeleteUserWebAuthnCredentials,
+	}
+	for _, del := range deletes {
+		err := del(ctx, userID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
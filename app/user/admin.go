@@ -0,0 +1,476 @@
+package user
+
+import (
+	"app/jwt"
+	"app/policy"
+	"app/repository"
+	"app/server"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrNotAuthorized    = errors.New("not authorized")
+	ErrAccountSuspended = errors.New("account suspended")
+)
+
+// Status is the standing of an account. Suspended accounts come back on
+// their own once the suspension ends, banned ones only when reinstated.
+type Status string
+
+const (
+	StatusActive    Status = "active"
+	StatusSuspended Status = "suspended"
+	StatusBanned    Status = "banned"
+)
+
+const impersonationTTL = time.Hour
+
+// Audit actions recorded for admin user management.
+const (
+	auditSuspend     = "user.suspend"
+	auditBan         = "user.ban"
+	auditReinstate   = "user.reinstate"
+	auditImpersonate = "user.impersonate"
+)
+
+// AdminUser is a user as shown to admins.
+type AdminUser struct {
+	ID             int        `json:"id"`
+	Name           string     `json:"name"`
+	Email          string     `json:"email"`
+	EmailVerified  bool       `json:"email_verified"`
+	Role           string     `json:"role"`
+	Status         Status     `json:"status"`
+	SuspendedUntil *time.Time `json:"suspended_until,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+type AuditEntry struct {
+	ID           int       `json:"id"`
+	ActorID      *int      `json:"actor_id"`
+	Action       string    `json:"action"`
+	TargetUserID *int      `json:"target_user_id"`
+	Detail       string    `json:"detail"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+type UsersParam struct {
+	Query  string
+	Status Status
+	Page   int
+	Size   int
+}
+
+// checkActive returns ErrAccountSuspended if u may not sign in at now.
+func checkActive(u *repository.User, now time.Time) error {
+	switch Status(u.Status) {
+	case StatusBanned:
+		return fmt.Errorf("%w: account is banned", ErrAccountSuspended)
+	case StatusSuspended:
+		if u.SuspendedUntil == nil {
+			return ErrAccountSuspended
+		}
+		if now.Before(*u.SuspendedUntil) {
+			return fmt.Errorf("%w until %s", ErrAccountSuspended, u.SuspendedUntil.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// ensureActive loads the user and checks that they may sign in.
+func (s *Service) ensureActive(ctx context.Context, userID int) error {
+	u := repository.New(s.db).User(ctx, userID)
+	if u == nil {
+		return fmt.Errorf("user with id %d: %w", userID, ErrInvalidToken)
+	}
+	return checkActive(u, time.Now())
+}
+
+// requireAdmin checks that actorID may manage the user targetID.
+func (s *Service) requireAdmin(ctx context.Context, r *repository.Repository, actorID, targetID int) error {
+	u := r.User(ctx, actorID)
+	if u == nil {
+		return fmt.Errorf("unknown user with id %d: %w", actorID, ErrNotAuthorized)
+	}
+
+	actor := policy.Actor{ID: u.ID, Role: policy.Role(u.Role)}
+	if !s.policy.Can(actor, policy.ActionManageUsers, targetID) {
+		return ErrNotAuthorized
+	}
+	return nil
+}
+
+func (s *Service) UsersHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		param := UsersParam{
+			Query:  q.Get("q"),
+			Status: Status(q.Get("status")),
+			Page:   1,
+			Size:   20,
+		}
+
+		var errs []error
+		if v := q.Get("page"); v != "" {
+			page, err := strconv.Atoi(v)
+			if err != nil {
+				errs = append(errs, err)
+			}
+			param.Page = page
+		}
+		if v := q.Get("size"); v != "" {
+			size, err := strconv.Atoi(v)
+			if err != nil {
+				errs = append(errs, err)
+			}
+			param.Size = size
+		}
+		if len(errs) > 0 {
+			server.ErrorResponse(w, http.StatusBadRequest, errors.Join(errs...))
+			return
+		}
+
+		users, total, err := s.Users(r.Context(), IDFromContext(r.Context()), param)
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+
+		output := struct {
+			Total int         `json:"total"`
+			Data  []AdminUser `json:"data"`
+		}{
+			Total: total,
+			Data:  users,
+		}
+		server.JSONResponse(w, http.StatusOK, output)
+	}
+}
+
+// Users searches users by name or email.
+func (s *Service) Users(ctx context.Context, actorID int, param UsersParam) ([]AdminUser, int, error) {
+	repo := repository.New(s.db)
+	err := s.requireAdmin(ctx, repo, actorID, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	repoParam := repository.UsersParam{
+		Query:  param.Query,
+		Status: string(param.Status),
+	}
+	repoParam.Page = param.Page
+	repoParam.Size = param.Size
+	us, total := repo.Users(ctx, repoParam)
+
+	res := make([]AdminUser, 0, len(us))
+	for _, u := range us {
+		res = append(res, mapAdminUserRepoToService(u))
+	}
+	return res, total, nil
+}
+
+func (s *Service) SuspendUserHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		targetID, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			server.ErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		var input struct {
+			Until  *time.Time `json:"until"`
+			Reason string     `json:"reason"`
+		}
+		err = json.NewDecoder(r.Body).Decode(&input)
+		if err != nil {
+			server.ErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		err = s.SuspendUser(r.Context(), IDFromContext(r.Context()), targetID, input.Until, input.Reason)
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// SuspendUser blocks the user until the given time, or until reinstated when
+// until is nil, and signs them out everywhere.
+func (s *Service) SuspendUser(ctx context.Context, actorID, targetID int, until *time.Time, reason string) error {
+	if until != nil && !until.After(time.Now()) {
+		return server.FieldErrors{"until": "must be in the future"}
+	}
+
+	detail := reason
+	if until != nil {
+		detail = fmt.Sprintf("until %s: %s", until.Format(time.RFC3339), reason)
+	}
+	return s.setUserStatus(ctx, actorID, targetID, StatusSuspended, until, auditSuspend, detail)
+}
+
+func (s *Service) BanUserHandler() func(w http.ResponseWriter, r *http.Request) {
+	return s.statusHandler(StatusBanned, auditBan)
+}
+
+func (s *Service) ReinstateUserHandler() func(w http.ResponseWriter, r *http.Request) {
+	return s.statusHandler(StatusActive, auditReinstate)
+}
+
+func (s *Service) statusHandler(status Status, action string) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		targetID, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			server.ErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		var input struct {
+			Reason string `json:"reason"`
+		}
+		if r.ContentLength != 0 {
+			err = json.NewDecoder(r.Body).Decode(&input)
+			if err != nil {
+				server.ErrorResponse(w, http.StatusBadRequest, err)
+				return
+			}
+		}
+
+		err = s.setUserStatus(r.Context(), IDFromContext(r.Context()), targetID, status, nil, action, input.Reason)
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// setUserStatus changes the status of targetID on behalf of the admin
+// actorID and records it in the audit log. Users who lose access are signed
+// out everywhere.
+func (s *Service) setUserStatus(ctx context.Context, actorID, targetID int, status Status, until *time.Time, action, detail string) error {
+	if actorID == targetID {
+		return fmt.Errorf("%w: cannot change the status of your own account", ErrNotAuthorized)
+	}
+
+	err := s.execInTx(ctx, func(r *repository.Repository) error {
+		err := s.requireAdmin(ctx, r, actorID, targetID)
+		if err != nil {
+			return err
+		}
+
+		r.ForUpdate = true
+		u := r.User(ctx, targetID)
+		if u == nil {
+			return fmt.Errorf("user with id %d: %w", targetID, ErrNotFound)
+		}
+
+		err = r.UpdateUserStatus(ctx, u.ID, string(status), until)
+		if err != nil {
+			return err
+		}
+		return r.CreateAuditLog(ctx, repository.AuditLog{
+			ActorID:      &actorID,
+			Action:       action,
+			TargetUserID: &targetID,
+			Detail:       detail,
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	if status == StatusActive {
+		return nil
+	}
+	return s.RevokeAllSessions(ctx, targetID)
+}
+
+func (s *Service) ImpersonateUserHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		targetID, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			server.ErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		var input struct {
+			Reason string `json:"reason"`
+		}
+		err = json.NewDecoder(r.Body).Decode(&input)
+		if err != nil {
+			server.ErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		token, expiresAt, err := s.ImpersonateUser(r.Context(), IDFromContext(r.Context()), targetID, input.Reason)
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+
+		output := struct {
+			AccessToken string    `json:"access_token"`
+			ExpiresAt   time.Time `json:"expires_at"`
+		}{
+			AccessToken: token,
+			ExpiresAt:   expiresAt,
+		}
+		server.JSONResponse(w, http.StatusOK, output)
+	}
+}
+
+// ImpersonateUser issues the admin actorID a short lived access token acting
+// as targetID. The token carries the admin in its "act" claim so every
+// request made with it can be attributed, and cannot be refreshed.
+func (s *Service) ImpersonateUser(ctx context.Context, actorID, targetID int, reason string) (string, time.Time, error) {
+	if actorID == targetID {
+		return "", time.Time{}, fmt.Errorf("%w: cannot impersonate yourself", ErrNotAuthorized)
+	}
+	if reason == "" {
+		return "", time.Time{}, server.FieldErrors{"reason": "is required"}
+	}
+
+	var generation int
+	err := s.execInTx(ctx, func(r *repository.Repository) error {
+		err := s.requireAdmin(ctx, r, actorID, targetID)
+		if err != nil {
+			return err
+		}
+
+		u := r.User(ctx, targetID)
+		if u == nil {
+			return fmt.Errorf("user with id %d: %w", targetID, ErrNotFound)
+		}
+		if policy.Role(u.Role) == policy.RoleAdmin {
+			return fmt.Errorf("%w: cannot impersonate an admin", ErrNotAuthorized)
+		}
+		generation = u.TokenGeneration
+
+		return r.CreateAuditLog(ctx, repository.AuditLog{
+			ActorID:      &actorID,
+			Action:       auditImpersonate,
+			TargetUserID: &targetID,
+			Detail:       reason,
+		})
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	claims := accessClaims{
+		Claims:     s.signer.NewClaims(strconv.Itoa(targetID), accessTokenAudience, impersonationTTL),
+		Actor:      &actorClaim{Subject: strconv.Itoa(actorID)},
+		Generation: generation,
+	}
+	token, err := s.signer.Sign(claims)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("unable to sign impersonation token: %w", err)
+	}
+	return token, time.Unix(claims.ExpiresAt, 0), nil
+}
+
+func (s *Service) AuditLogHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		targetID, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			server.ErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		entries, err := s.AuditLog(r.Context(), IDFromContext(r.Context()), targetID)
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+
+		output := struct {
+			Entries []AuditEntry `json:"entries"`
+		}{
+			Entries: entries,
+		}
+		server.JSONResponse(w, http.StatusOK, output)
+	}
+}
+
+// AuditLog returns the admin actions taken on targetID, newest first.
+func (s *Service) AuditLog(ctx context.Context, actorID, targetID int) ([]AuditEntry, error) {
+	repo := repository.New(s.db)
+	err := s.requireAdmin(ctx, repo, actorID, targetID)
+	if err != nil {
+		return nil, err
+	}
+
+	logs := repo.AuditLogs(ctx, targetID)
+	res := make([]AuditEntry, 0, len(logs))
+	for _, l := range logs {
+		res = append(res, AuditEntry{
+			ID:           l.ID,
+			ActorID:      l.ActorID,
+			Action:       l.Action,
+			TargetUserID: l.TargetUserID,
+			Detail:       l.Detail,
+			CreatedAt:    l.CreatedAt,
+		})
+	}
+	return res, nil
+}
+
+// logImpersonation leaves a trace of every request made while an admin
+// impersonates a user.
+func logImpersonation(r *http.Request, userID, impersonatorID int) {
+	slog.Info("impersonated request",
+		"admin_id", impersonatorID, "user_id", userID, "method", r.Method, "path", r.URL.Path)
+}
+
+func writeAdminError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	var fields server.FieldErrors
+	switch {
+	case errors.As(err, &fields):
+		status = http.StatusUnprocessableEntity
+	case errors.Is(err, ErrNotAuthorized):
+		status = http.StatusForbidden
+	case errors.Is(err, ErrNotFound):
+		status = http.StatusNotFound
+	}
+	server.ErrorResponse(w, status, err)
+}
+
+func mapAdminUserRepoToService(data repository.User) AdminUser {
+	return AdminUser{
+		ID:             data.ID,
+		Name:           data.Name,
+		Email:          data.Email,
+		EmailVerified:  data.EmailVerifiedAt != nil,
+		Role:           data.Role,
+		Status:         Status(data.Status),
+		SuspendedUntil: data.SuspendedUntil,
+		CreatedAt:      data.CreatedAt,
+	}
+}
+
+// accessClaims are the claims of access tokens. Actor is only set on tokens
+// issued for impersonation and names the admin behind them, as in the "act"
+// claim of RFC 8693.
+type accessClaims struct {
+	jwt.Claims
+	Actor *actorClaim `json:"act,omitempty"`
+	// Generation is the token generation of the user at issue time.
+	Generation int `json:"gen"`
+}
+
+type actorClaim struct {
+	Subject string `json:"sub"`
+}
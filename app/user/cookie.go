@@ -0,0 +1,88 @@
+package user
+
+import (
+	"app/server"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"time"
+)
+
+var ErrInvalidCSRF = errors.New("missing or invalid CSRF token")
+
+const (
+	sessionCookieName = "session"
+	csrfHeaderName    = "X-CSRF-Token"
+)
+
+// cookieMode reports whether the client asked for a browser session kept in
+// a cookie instead of tokens in the response body.
+func cookieMode(r *http.Request) bool {
+	return r.URL.Query().Get("mode") == "cookie"
+}
+
+func (s *Service) setSessionCookie(w http.ResponseWriter, token string, expiresAt time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  expiresAt,
+		HttpOnly: true,
+		Secure:   s.cookieSecure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (s *Service) clearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   s.cookieSecure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// csrfToken derives the synchronizer token of a cookie session. It is bound
+// to the session and cannot be computed without the session token, which
+// scripts cannot read from the HttpOnly cookie.
+func csrfToken(sessionToken string) string {
+	mac := hmac.New(sha256.New, []byte(sessionToken))
+	mac.Write([]byte("csrf"))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// validCSRF reports whether r may act on the cookie session sessionToken.
+// Safe methods pass, anything else must echo the CSRF token in a header.
+func validCSRF(r *http.Request, sessionToken string) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+
+	got := r.Header.Get(csrfHeaderName)
+	return got != "" && subtle.ConstantTimeCompare([]byte(got), []byte(csrfToken(sessionToken))) == 1
+}
+
+// CSRFHandler returns the CSRF token of the cookie session, so a reloaded
+// page can pick it up again.
+func (s *Service) CSRFHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, fromCookie := requestToken(r)
+		if !fromCookie {
+			server.ErrorResponse(w, http.StatusBadRequest, ErrInvalidToken)
+			return
+		}
+
+		output := struct {
+			CSRFToken string `json:"csrf_token"`
+		}{
+			CSRFToken: csrfToken(token),
+		}
+		server.JSONResponse(w, http.StatusOK, output)
+	}
+}
@@ -0,0 +1,266 @@
+package user
+
+import (
+	"app/mailer"
+	"app/repository"
+	"app/server"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	purposeConfirmation = "confirmation"
+	confirmationCodeTTL = 15 * time.Minute
+)
+
+func (s *Service) ChangePasswordHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input struct {
+			CurrentPassword string `json:"current_password"`
+			NewPassword     string `json:"new_password"`
+		}
+
+		err := json.NewDecoder(r.Body).Decode(&input)
+		if err != nil {
+			server.ErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		ctx := r.Context()
+		err = s.ChangePassword(ctx, IDFromContext(ctx), TokenFromContext(ctx),
+			input.CurrentPassword, input.NewPassword, server.ClientIP(r))
+		if err != nil {
+			writeCredentialsError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// ChangePassword replaces the password of the user after checking the
+// current one. Every other session, all refresh tokens and all access tokens
+// are revoked, the session identified by currentToken stays signed in.
+func (s *Service) ChangePassword(ctx context.Context, userID int, currentToken, currentPassword, newPassword, ip string) error {
+	if problems := s.passwordPolicy.Validate(newPassword); len(problems) > 0 {
+		return server.FieldErrors{"new_password": strings.Join(problems, ", ")}
+	}
+
+	_, err := s.reauthenticate(ctx, userID, currentPassword, ip)
+	if err != nil {
+		return err
+	}
+
+	passwordHash, err := s.hasher.Hash(newPassword)
+	if err != nil {
+		return fmt.Errorf("error change password: %w", err)
+	}
+
+	err = s.execInTx(ctx, func(r *repository.Repository) error {
+		err := r.UpdateUserPassword(ctx, userID, passwordHash)
+		if err != nil {
+			return err
+		}
+		err = r.RevokeUserAccessTokens(ctx, userID)
+		if err != nil {
+			return err
+		}
+		return r.DeleteUserTokens(ctx, userID, purposePasswordReset)
+	})
+	if err != nil {
+		return err
+	}
+
+	err = s.sessions.DeleteOthers(ctx, userID, currentToken)
+	if err != nil {
+		return fmt.Errorf("unable to revoke sessions of user %d: %w", userID, err)
+	}
+
+	err = s.refreshTokens.DeleteByUser(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("unable to revoke refresh tokens of user %d: %w", userID, err)
+	}
+	return nil
+}
+
+func (s *Service) ChangeEmailHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input struct {
+			CurrentPassword string `json:"current_password"`
+			Email           string `json:"email"`
+		}
+
+		err := json.NewDecoder(r.Body).Decode(&input)
+		if err != nil {
+			server.ErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		ctx := r.Context()
+		err = s.ChangeEmail(ctx, IDFromContext(ctx), input.CurrentPassword, input.Email, server.ClientIP(r))
+		if err != nil {
+			writeCredentialsError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// ChangeEmail moves the account to a new address after checking the current
+// password. The new address starts unverified and gets a verification link,
+// the old one is told about the change.
+func (s *Service) ChangeEmail(ctx context.Context, userID int, currentPassword, email, ip string) error {
+	email = strings.TrimSpace(email)
+	if _, err := mail.ParseAddress(email); err != nil {
+		return server.FieldErrors{"email": "is not a valid email address"}
+	}
+
+	u, err := s.reauthenticate(ctx, userID, currentPassword, ip)
+	if err != nil {
+		return err
+	}
+	if u.Email == email {
+		return nil
+	}
+
+	err = s.execInTx(ctx, func(r *repository.Repository) error {
+		err := r.UpdateUserEmail(ctx, userID, email)
+		if repository.IsDuplicate(err) {
+			return fmt.Errorf("email %s: %w", email, ErrAlreadyRegistered)
+		}
+		if err != nil {
+			return err
+		}
+
+		// Reset links went to the old address.
+		return r.DeleteUserTokens(ctx, userID, purposePasswordReset)
+	})
+	if err != nil {
+		return err
+	}
+
+	sendInBackground(ctx, "verification email", func(ctx context.Context) error {
+		return s.sendVerification(ctx, userID, u.Name, email)
+	})
+	sendInBackground(ctx, "email change notice", func(ctx context.Context) error {
+		return s.mailer.Send(ctx, mailer.Message{
+			To:      u.Email,
+			Subject: "Your email address was changed",
+			Body: fmt.Sprintf("Hi %s,\n\nThe email address of your account was changed to %s.\n\n"+
+				"If you did not make this change, reset your password and contact us.\n", u.Name, email),
+		})
+	})
+	return nil
+}
+
+// reauthenticate checks password for an already signed in user before a
+// sensitive change. Wrong passwords are throttled like failed logins.
+func (s *Service) reauthenticate(ctx context.Context, userID int, password, ip string) (*repository.User, error) {
+	accountKey := reauthThrottleKey(userID)
+	if err := s.attempt(accountKey, ip); err != nil {
+		return nil, err
+	}
+
+	u := repository.New(s.db).User(ctx, userID)
+	if u == nil {
+		s.refundAttempt(accountKey, ip)
+		return nil, fmt.Errorf("user with id %d: %w", userID, ErrNotFound)
+	}
+
+	if !s.checkPassword(ctx, u, password) {
+		return nil, fmt.Errorf("%w: wrong current password", ErrInvalidLogin)
+	}
+
+	s.succeeded(accountKey, ip)
+	return u, nil
+}
+
+func (s *Service) ConfirmationCodeHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := s.SendConfirmationCode(r.Context(), IDFromContext(r.Context()))
+		if err != nil {
+			writeCredentialsError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// SendConfirmationCode emails the user a single use code that stands in for
+// the current password where one is asked for, so users who sign in without
+// a password can confirm sensitive changes too.
+func (s *Service) SendConfirmationCode(ctx context.Context, userID int) error {
+	err := limitMail(s.mailLimiter, "confirm:"+strconv.Itoa(userID))
+	if err != nil {
+		return err
+	}
+
+	repo := repository.New(s.db)
+	u := repo.User(ctx, userID)
+	if u == nil {
+		return fmt.Errorf("user with id %d: %w", userID, ErrNotFound)
+	}
+
+	code, err := s.createUserToken(ctx, repo, u.ID, purposeConfirmation, confirmationCodeTTL)
+	if err != nil {
+		return fmt.Errorf("unable to create confirmation code: %w", err)
+	}
+
+	sendInBackground(ctx, "confirmation code", func(ctx context.Context) error {
+		return s.mailer.Send(ctx, mailer.Message{
+			To:      u.Email,
+			Subject: "Your confirmation code",
+			Body: fmt.Sprintf("Hi %s,\n\nEnter the code below to confirm the change to your account. It expires in %s and works once.\n\n%s\n\n"+
+				"If you did not ask for it, reset your password.\n", u.Name, confirmationCodeTTL, code),
+		})
+	})
+	return nil
+}
+
+// confirmUser checks that the signed in user is present before a sensitive
+// change, either by their current password or by a code sent with
+// SendConfirmationCode.
+func (s *Service) confirmUser(ctx context.Context, userID int, password, code, ip string) error {
+	if code == "" {
+		_, err := s.reauthenticate(ctx, userID, password, ip)
+		return err
+	}
+
+	return s.execInTx(ctx, func(r *repository.Repository) error {
+		r.ForUpdate = true
+		ut, err := s.useUserToken(ctx, r, code, purposeConfirmation)
+		if err != nil || ut.UserID != userID {
+			return fmt.Errorf("%w: invalid confirmation code", ErrInvalidLogin)
+		}
+		return nil
+	})
+}
+
+func writeCredentialsError(w http.ResponseWriter, err error) {
+	if writeLocked(w, err) {
+		return
+	}
+
+	status := http.StatusInternalServerError
+	var fields server.FieldErrors
+	switch {
+	case errors.As(err, &fields):
+		status = http.StatusUnprocessableEntity
+	case errors.Is(err, ErrInvalidLogin):
+		status = http.StatusForbidden
+	case errors.Is(err, ErrAlreadyRegistered):
+		status = http.StatusConflict
+	case errors.Is(err, ErrNotFound):
+		status = http.StatusNotFound
+	}
+	server.ErrorResponse(w, status, err)
+}
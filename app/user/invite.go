@@ -0,0 +1,231 @@
+package user
+
+import (
+	"app/policy"
+	"app/repository"
+	"app/server"
+	"app/session"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrRegistrationClosed = errors.New("registration is closed")
+	ErrInvalidInvite      = errors.New("invalid invite code")
+)
+
+// RegistrationMode decides who may create an account.
+type RegistrationMode string
+
+const (
+	// RegistrationOpen lets anyone register.
+	RegistrationOpen RegistrationMode = "open"
+	// RegistrationInvite requires an invite code created by an admin.
+	RegistrationInvite RegistrationMode = "invite"
+	// RegistrationClosed turns registration off.
+	RegistrationClosed RegistrationMode = "closed"
+)
+
+// Invite is an invite code as shown to admins. Code is only set right
+// after creation, only its hash is stored.
+type Invite struct {
+	ID        int        `json:"id"`
+	Code      string     `json:"code,omitempty"`
+	Role      string     `json:"role"`
+	MaxUses   int        `json:"max_uses"`
+	Uses      int        `json:"uses"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	CreatedBy *int       `json:"created_by"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+type InviteInput struct {
+	Role      string     `json:"role"`
+	MaxUses   int        `json:"max_uses"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+func (s *Service) CreateInviteHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input InviteInput
+		err := json.NewDecoder(r.Body).Decode(&input)
+		if err != nil {
+			server.ErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		inv, err := s.CreateInvite(r.Context(), IDFromContext(r.Context()), input)
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+
+		server.JSONResponse(w, http.StatusCreated, inv)
+	}
+}
+
+// CreateInvite creates an invite code that registers users with the given
+// role. A zero MaxUses allows a single use.
+func (s *Service) CreateInvite(ctx context.Context, actorID int, input InviteInput) (*Invite, error) {
+	if input.Role == "" {
+		input.Role = string(policy.RoleAuthor)
+	}
+	if input.MaxUses == 0 {
+		input.MaxUses = 1
+	}
+
+	fields := server.FieldErrors{}
+	if !policy.Role(input.Role).Valid() {
+		fields["role"] = "is not a known role"
+	}
+	if input.MaxUses < 0 {
+		fields["max_uses"] = "must be positive"
+	}
+	if input.ExpiresAt != nil && !input.ExpiresAt.After(time.Now()) {
+		fields["expires_at"] = "must be in the future"
+	}
+	if len(fields) > 0 {
+		return nil, fields
+	}
+
+	code, err := session.NewToken()
+	if err != nil {
+		return nil, err
+	}
+
+	var res Invite
+	err = s.execInTx(ctx, func(r *repository.Repository) error {
+		err := s.requireAdmin(ctx, r, actorID, 0)
+		if err != nil {
+			return err
+		}
+
+		data := repository.Invite{
+			CodeHash:  session.HashToken(code),
+			Role:      input.Role,
+			MaxUses:   input.MaxUses,
+			ExpiresAt: input.ExpiresAt,
+			CreatedBy: &actorID,
+			CreatedAt: time.Now(),
+		}
+		data.ID, err = r.CreateInvite(ctx, data)
+		if err != nil {
+			return err
+		}
+
+		res = mapInviteRepoToService(data)
+		res.Code = code
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func (s *Service) InvitesHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		invites, err := s.Invites(r.Context(), IDFromContext(r.Context()))
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+
+		output := struct {
+			Invites []Invite `json:"invites"`
+		}{
+			Invites: invites,
+		}
+		server.JSONResponse(w, http.StatusOK, output)
+	}
+}
+
+func (s *Service) Invites(ctx context.Context, actorID int) ([]Invite, error) {
+	repo := repository.New(s.db)
+	err := s.requireAdmin(ctx, repo, actorID, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	invites := repo.Invites(ctx)
+	res := make([]Invite, 0, len(invites))
+	for _, inv := range invites {
+		res = append(res, mapInviteRepoToService(inv))
+	}
+	return res, nil
+}
+
+func (s *Service) RevokeInviteHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			server.ErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		err = s.RevokeInvite(r.Context(), IDFromContext(r.Context()), id)
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func (s *Service) RevokeInvite(ctx context.Context, actorID, id int) error {
+	repo := repository.New(s.db)
+	err := s.requireAdmin(ctx, repo, actorID, 0)
+	if err != nil {
+		return err
+	}
+
+	n, err := repo.DeleteInvite(ctx, id)
+	if err != nil {
+		return fmt.Errorf("unable to revoke invite %d: %w", id, err)
+	}
+	if n == 0 {
+		return fmt.Errorf("invite with id %d: %w", id, ErrNotFound)
+	}
+	return nil
+}
+
+// redeemInvite counts a use of the invite code and returns the role it
+// grants. It must run in a transaction so that concurrent registrations
+// cannot use the code more often than allowed.
+func (s *Service) redeemInvite(ctx context.Context, r *repository.Repository, code string) (policy.Role, error) {
+	r.ForUpdate = true
+	inv := r.InviteWithHash(ctx, session.HashToken(code))
+	if inv == nil {
+		return "", ErrInvalidInvite
+	}
+	if inv.ExpiresAt != nil && !time.Now().Before(*inv.ExpiresAt) {
+		return "", fmt.Errorf("%w: expired", ErrInvalidInvite)
+	}
+	if inv.Uses >= inv.MaxUses {
+		return "", fmt.Errorf("%w: already used up", ErrInvalidInvite)
+	}
+
+	err := r.UseInvite(ctx, inv.ID)
+	if err != nil {
+		return "", err
+	}
+	return policy.Role(inv.Role), nil
+}
+
+func mapInviteRepoToService(data repository.Invite) Invite {
+	return Invite{
+		ID:        data.ID,
+		Role:      data.Role,
+		MaxUses:   data.MaxUses,
+		Uses:      data.Uses,
+		ExpiresAt: data.ExpiresAt,
+		CreatedBy: data.CreatedBy,
+		CreatedAt: data.CreatedAt,
+	}
+}
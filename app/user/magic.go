@@ -0,0 +1,201 @@
+package user
+
+import (
+	"app/jwt"
+	"app/mailer"
+	"app/repository"
+	"app/server"
+	"app/session"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	purposeMagicLink  = "magic_link"
+	magicLinkAudience = "magic-link"
+	magicLinkTTL      = 15 * time.Minute
+)
+
+func (s *Service) MagicLinkHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input struct {
+			Email string `json:"email"`
+		}
+
+		err := json.NewDecoder(r.Body).Decode(&input)
+		if err != nil {
+			server.ErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		err = s.SendMagicLink(r.Context(), input.Email, server.ClientIP(r), cookieMode(r))
+		if writeLocked(w, err) {
+			return
+		}
+		// Other failures are not reported so the endpoint cannot be used
+		// to probe which emails are registered.
+		if err != nil {
+			slog.Error("failed to send magic link", "err", err)
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// SendMagicLink emails a single use sign in link to email if it belongs to
+// an active user. Requests are limited per email and per client IP whether
+// or not the email is known, and the email is sent in the background. The
+// link keeps cookie mode when requested.
+func (s *Service) SendMagicLink(ctx context.Context, email, ip string, cookie bool) error {
+	err := limitMail(s.magicLinkLimiter, emailThrottleKey(email), "ip:"+ip)
+	if err != nil {
+		return err
+	}
+
+	sendInBackground(ctx, "magic link", func(ctx context.Context) error {
+		return s.sendMagicLink(ctx, email, cookie)
+	})
+	return nil
+}
+
+func (s *Service) sendMagicLink(ctx context.Context, email string, cookie bool) error {
+	repo := repository.New(s.db)
+	u := repo.UserWithEmail(ctx, email)
+	if u == nil || checkActive(u, time.Now()) != nil {
+		return nil
+	}
+
+	// The stored single use token travels as the "jti" of a signed link,
+	// so a link can neither be forged nor replayed.
+	jti, err := s.createUserToken(ctx, repo, u.ID, purposeMagicLink, magicLinkTTL)
+	if err != nil {
+		return fmt.Errorf("unable to create magic link token: %w", err)
+	}
+
+	claims := s.signer.NewClaims(strconv.Itoa(u.ID), magicLinkAudience, magicLinkTTL)
+	claims.ID = jti
+	token, err := s.signer.Sign(claims)
+	if err != nil {
+		return fmt.Errorf("unable to sign magic link: %w", err)
+	}
+
+	link := s.baseURL + "/login/magic/" + url.PathEscape(token)
+	if cookie {
+		link += "?mode=cookie"
+	}
+	return s.mailer.Send(ctx, mailer.Message{
+		To:      u.Email,
+		Subject: "Your sign in link",
+		Body: fmt.Sprintf("Hi %s,\n\nOpen the link below to sign in. It expires in %s and works once.\n\n%s\n\n"+
+			"If you did not ask to sign in you can ignore this email.\n",
+			u.Name, magicLinkTTL, link),
+	})
+}
+
+// MagicLinkPageHandler serves the page the emailed link opens. Mail
+// scanners open links too, so only submitting the page redeems the link.
+func (s *Service) MagicLinkPageHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		action := "/login/magic/" + url.PathEscape(r.PathValue("token"))
+		if cookieMode(r) {
+			action += "?mode=cookie"
+		}
+		writeConfirmPage(w, confirmPageData{
+			Title:   "Sign in",
+			Message: "Continue to sign in with the link from your email.",
+			Button:  "Sign in",
+			Done:    "You are signed in.",
+			Action:  action,
+			Token:   r.PathValue("token"),
+		})
+	}
+}
+
+func (s *Service) MagicLinkLoginHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		creds, err := s.LoginWithMagicLink(r.Context(), r.PathValue("token"), clientFromRequest(r))
+		if err != nil {
+			status := http.StatusInternalServerError
+			switch {
+			case errors.Is(err, ErrInvalidToken):
+				status = http.StatusUnauthorized
+			case errors.Is(err, ErrAccountSuspended):
+				status = http.StatusForbidden
+			}
+			server.ErrorResponse(w, status, err)
+			return
+		}
+
+		s.writeCredentials(w, r, creds, cookieMode(r))
+	}
+}
+
+// LoginWithMagicLink redeems a link sent by SendMagicLink. The link stands
+// in for the password, a second factor is still asked for when enabled.
+// Because opening the link proves the user controls the address, it also
+// verifies their email. On an unverified account the credentials set up by
+// whoever registered the address are wiped first, as in LoginWithOIDC, so
+// they cannot sign in once the owner has taken it over.
+func (s *Service) LoginWithMagicLink(ctx context.Context, token string, client session.Client) (Credentials, error) {
+	var claims jwt.Claims
+	err := s.signer.Verify(token, magicLinkAudience, &claims)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	var u *repository.User
+	var takenOver bool
+	err = s.execInTx(ctx, func(r *repository.Repository) error {
+		r.ForUpdate = true
+		ut, err := s.useUserToken(ctx, r, claims.ID, purposeMagicLink)
+		if err != nil {
+			return err
+		}
+		if strconv.Itoa(ut.UserID) != claims.Subject {
+			return fmt.Errorf("%w: subject mismatch", ErrInvalidToken)
+		}
+
+		u = r.User(ctx, ut.UserID)
+		if u == nil {
+			return ErrInvalidToken
+		}
+		if u.EmailVerifiedAt != nil {
+			return nil
+		}
+
+		err = resetCredentials(ctx, r, u.ID)
+		if err != nil {
+			return err
+		}
+		err = r.MarkUserEmailVerified(ctx, u.ID, time.Now())
+		if err != nil {
+			return err
+		}
+		takenOver = true
+
+		u = r.User(ctx, u.ID)
+		if u == nil {
+			return ErrInvalidToken
+		}
+		return nil
+	})
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	if takenOver {
+		err = s.RevokeAllSessions(ctx, u.ID)
+		if err != nil {
+			return Credentials{}, err
+		}
+	}
+
+	return s.completeLogin(ctx, u, client)
+}
@@ -0,0 +1,39 @@
+package user
+
+import (
+	"app/throttle"
+	"context"
+	"log/slog"
+	"time"
+)
+
+// mailTimeout bounds sending an email in the background.
+const mailTimeout = 30 * time.Second
+
+// sendInBackground runs send detached from the request, so the response
+// neither waits for the mail server nor, by its timing, tells whether an
+// email went out at all.
+func sendInBackground(ctx context.Context, what string, send func(context.Context) error) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), mailTimeout)
+	go func() {
+		defer cancel()
+		if err := send(ctx); err != nil {
+			slog.Error("failed to send "+what, "err", err)
+		}
+	}()
+}
+
+// limitMail counts an email request against every key, returning a
+// LockedError without counting anything when one of them is blocked.
+func limitMail(l *throttle.Limiter, keys ...string) error {
+	now := time.Now()
+	for i, key := range keys {
+		if d, ok := l.Attempt(key, now); !ok {
+			for _, k := range keys[:i] {
+				l.Refund(k)
+			}
+			return &LockedError{RetryAfter: d}
+		}
+	}
+	return nil
+}
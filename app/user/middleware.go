@@ -1,33 +1,173 @@
 package user
 
 import (
+	"app/jwt"
+	"app/server"
 	"app/session"
 	"context"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"strings"
 )
 
 type tokenCtxKey struct{}
 
-func TokenMiddleware(next func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+type sessionCtxKey struct{}
+
+type impersonatorCtxKey struct{}
+
+// TokenMiddleware authenticates the request with a bearer token or, for
+// browsers, the session cookie. Cookie authenticated requests that change
+// state must carry the CSRF token.
+func (s *Service) TokenMiddleware(next func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		token := r.Header.Get("Authorization")
+		token, fromCookie := requestToken(r)
 		if token == "" {
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
 
-		token = strings.TrimPrefix(token, "Bearer ")
-		id, ok := session.Get(token)
-		if !ok {
+		id, impersonatorID, err := s.authenticate(r.Context(), token, clientFromRequest(r))
+		if errors.Is(err, ErrAccountSuspended) {
+			server.ErrorResponse(w, http.StatusForbidden, err)
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if fromCookie && !validCSRF(r, token) {
+			server.ErrorResponse(w, http.StatusForbidden, ErrInvalidCSRF)
+			return
+		}
+
+		if impersonatorID != 0 && !impersonationAllows(r) {
+			server.ErrorResponse(w, http.StatusForbidden, fmt.Errorf("%w: not while impersonating", ErrNotAuthorized))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), tokenCtxKey{}, id)
+		ctx = context.WithValue(ctx, sessionCtxKey{}, token)
+		if impersonatorID != 0 {
+			ctx = context.WithValue(ctx, impersonatorCtxKey{}, impersonatorID)
+			logImpersonation(r, id, impersonatorID)
+		}
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// impersonationAllows reports whether an admin impersonating a user may make
+// request r. Impersonation is for seeing what the user sees, so the account
+// itself under /me is read only: sessions, tokens, passkeys, two-factor
+// settings and profile stay as the user left them.
+func impersonationAllows(r *http.Request) bool {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return true
+	}
+	return r.URL.Path != "/me" && !strings.HasPrefix(r.URL.Path, "/me/")
+}
+
+// OptionalTokenMiddleware authenticates requests that carry a token like
+// TokenMiddleware and lets anonymous requests through.
+func (s *Service) OptionalTokenMiddleware(next func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token, _ := requestToken(r); token == "" {
+			next(w, r)
+			return
+		}
+		s.TokenMiddleware(next)(w, r)
+	}
+}
+
+// ScopedTokenMiddleware is TokenMiddleware that additionally accepts personal
+// access tokens granted scope.
+func (s *Service) ScopedTokenMiddleware(scope string, next func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := bearerToken(r)
+		if !strings.HasPrefix(token, personalTokenPrefix) {
+			s.TokenMiddleware(next)(w, r)
+			return
+		}
+
+		id, pat, err := s.personalAccessToken(r.Context(), token)
+		if err != nil {
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
+		if err := s.ensureActive(r.Context(), id); err != nil {
+			server.ErrorResponse(w, http.StatusForbidden, err)
+			return
+		}
+		if !pat.HasScope(scope) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
 		ctx := context.WithValue(r.Context(), tokenCtxKey{}, id)
+		ctx = context.WithValue(ctx, sessionCtxKey{}, token)
 		next(w, r.WithContext(ctx))
 	}
 }
 
+func bearerToken(r *http.Request) string {
+	token := r.Header.Get("Authorization")
+	return strings.TrimPrefix(token, "Bearer ")
+}
+
+// requestToken returns the bearer token of r, falling back to the session
+// cookie, and reports whether it came from the cookie.
+func requestToken(r *http.Request) (string, bool) {
+	if token := bearerToken(r); token != "" {
+		return token, false
+	}
+
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil || cookie.Value == "" {
+		return "", false
+	}
+	return cookie.Value, true
+}
+
+// authenticate resolves token, either a signed access token or an opaque
+// session token, to a user ID and, for impersonation tokens, the ID of the
+// admin behind it. Personal access tokens are rejected, they are only valid
+// on routes guarded by ScopedTokenMiddleware. Suspended users are rejected
+// with ErrAccountSuspended.
+func (s *Service) authenticate(ctx context.Context, token string, client session.Client) (int, int, error) {
+	if strings.HasPrefix(token, personalTokenPrefix) {
+		return 0, 0, ErrInvalidToken
+	}
+	if jwt.IsJWT(token) {
+		t, err := s.verifyAccessToken(token)
+		if err != nil {
+			return 0, 0, err
+		}
+		if err := s.ensureAccessToken(ctx, t); err != nil {
+			return 0, 0, err
+		}
+		return t.UserID, t.ImpersonatorID, nil
+	}
+
+	sess, err := s.sessions.Get(ctx, token)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := s.ensureActive(ctx, sess.UserID); err != nil {
+		return 0, 0, err
+	}
+
+	if err := s.sessions.Touch(ctx, token, client); err != nil {
+		slog.Error("failed to touch session", "err", err)
+	}
+	return sess.UserID, 0, nil
+}
+
+func clientFromRequest(r *http.Request) session.Client {
+	return session.Client{IP: server.ClientIP(r), UserAgent: r.UserAgent()}
+}
+
 func IDFromContext(ctx context.Context) int {
 	v, ok := ctx.Value(tokenCtxKey{}).(int)
 	if !ok {
@@ -35,3 +175,21 @@ func IDFromContext(ctx context.Context) int {
 	}
 	return v
 }
+
+// ImpersonatorFromContext returns the ID of the admin impersonating the
+// signed in user, or 0 when the user is acting for themselves.
+func ImpersonatorFromContext(ctx context.Context) int {
+	v, ok := ctx.Value(impersonatorCtxKey{}).(int)
+	if !ok {
+		return 0
+	}
+	return v
+}
+
+func TokenFromContext(ctx context.Context) string {
+	v, ok := ctx.Value(sessionCtxKey{}).(string)
+	if !ok {
+		return ""
+	}
+	return v
+}
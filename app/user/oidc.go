@@ -0,0 +1,249 @@
+package user
+
+import (
+	"app/jwt"
+	"app/oidc"
+	"app/policy"
+	"app/repository"
+	"app/server"
+	"app/session"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var ErrUnverifiedEmail = errors.New("email is not verified")
+
+const (
+	oidcCookieName     = "oidc_auth"
+	oidcStateAudience  = "oidc-state"
+	oidcAuthRequestTTL = 10 * time.Minute
+)
+
+// oidcStateClaims carry the PKCE verifier, state and nonce of a pending login
+// in a signed cookie, so any app instance can complete the callback.
+type oidcStateClaims struct {
+	jwt.Claims
+	State        string `json:"state"`
+	Nonce        string `json:"nonce"`
+	CodeVerifier string `json:"cv"`
+	// Cookie remembers that the login was started in cookie mode.
+	Cookie bool `json:"cookie,omitempty"`
+}
+
+func (s *Service) OIDCStartHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, err := oidc.NewAuthRequest()
+		if err != nil {
+			server.ErrorResponse(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		authURL, err := s.oidc.AuthCodeURL(r.Context(), req)
+		if err != nil {
+			server.ErrorResponse(w, http.StatusBadGateway, err)
+			return
+		}
+
+		claims := oidcStateClaims{
+			Claims:       s.signer.NewClaims("", oidcStateAudience, oidcAuthRequestTTL),
+			State:        req.State,
+			Nonce:        req.Nonce,
+			CodeVerifier: req.CodeVerifier,
+			Cookie:       cookieMode(r),
+		}
+		value, err := s.signer.Sign(claims)
+		if err != nil {
+			server.ErrorResponse(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     oidcCookieName,
+			Value:    value,
+			Path:     "/auth/oidc",
+			MaxAge:   int(oidcAuthRequestTTL.Seconds()),
+			HttpOnly: true,
+			Secure:   s.cookieSecure,
+			SameSite: http.SameSiteLaxMode,
+		})
+		http.Redirect(w, r, authURL, http.StatusFound)
+	}
+}
+
+func (s *Service) OIDCCallbackHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{
+			Name:     oidcCookieName,
+			Path:     "/auth/oidc",
+			MaxAge:   -1,
+			HttpOnly: true,
+			Secure:   s.cookieSecure,
+			SameSite: http.SameSiteLaxMode,
+		})
+
+		q := r.URL.Query()
+		if e := q.Get("error"); e != "" {
+			server.ErrorResponse(w, http.StatusUnauthorized, fmt.Errorf("provider returned %s: %w", e, ErrInvalidLogin))
+			return
+		}
+
+		cookie, err := r.Cookie(oidcCookieName)
+		if err != nil {
+			server.ErrorResponse(w, http.StatusBadRequest, fmt.Errorf("missing login state: %w", ErrInvalidLogin))
+			return
+		}
+
+		var state oidcStateClaims
+		err = s.signer.Verify(cookie.Value, oidcStateAudience, &state)
+		if err != nil {
+			server.ErrorResponse(w, http.StatusBadRequest, fmt.Errorf("login state: %w", ErrInvalidLogin))
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(state.State), []byte(q.Get("state"))) != 1 {
+			server.ErrorResponse(w, http.StatusBadRequest, fmt.Errorf("state mismatch: %w", ErrInvalidLogin))
+			return
+		}
+
+		claims, err := s.oidc.Exchange(r.Context(), q.Get("code"), oidc.AuthRequest{
+			State:        state.State,
+			Nonce:        state.Nonce,
+			CodeVerifier: state.CodeVerifier,
+		})
+		if err != nil {
+			server.ErrorResponse(w, http.StatusUnauthorized, err)
+			return
+		}
+
+		creds, err := s.LoginWithOIDC(r.Context(), claims, clientFromRequest(r))
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, ErrUnverifiedEmail) || errors.Is(err, ErrAccountSuspended) ||
+				errors.Is(err, ErrRegistrationClosed) {
+				status = http.StatusForbidden
+			}
+			server.ErrorResponse(w, status, err)
+			return
+		}
+
+		s.writeCredentials(w, r, creds, state.Cookie)
+	}
+}
+
+// LoginWithOIDC signs in the user linked to the provider identity in claims,
+// asking for the second factor when the user enabled one. An unlinked
+// identity is linked to the account with the same email, or to a new account
+// when there is none. When that account never verified its email, whoever
+// registered it may not own the address, so every credential they set up is
+// dropped in favour of the provider.
+func (s *Service) LoginWithOIDC(ctx context.Context, claims oidc.IDClaims, client session.Client) (Credentials, error) {
+	if claims.Email == "" || !claims.EmailVerified {
+		return Credentials{}, fmt.Errorf("oidc login for %q: %w", claims.Subject, ErrUnverifiedEmail)
+	}
+
+	var userID int
+	var takenOver bool
+	err := s.execInTx(ctx, func(r *repository.Repository) error {
+		ident := r.UserIdentity(ctx, claims.Issuer, claims.Subject)
+		if ident != nil {
+			userID = ident.UserID
+			return nil
+		}
+
+		u := r.UserWithEmail(ctx, claims.Email)
+		if u != nil {
+			userID = u.ID
+			if u.EmailVerifiedAt == nil {
+				err := resetCredentials(ctx, r, u.ID)
+				if err != nil {
+					return err
+				}
+				err = r.MarkUserEmailVerified(ctx, u.ID, time.Now())
+				if err != nil {
+					return err
+				}
+				takenOver = true
+			}
+		} else {
+			// Single sign-on must not bypass invite-only or closed
+			// registration.
+			if s.registrationMode != RegistrationOpen {
+				return fmt.Errorf("no account for %s: %w", claims.Email, ErrRegistrationClosed)
+			}
+
+			name := claims.Name
+			if name == "" {
+				name, _, _ = strings.Cut(claims.Email, "@")
+			}
+
+			// SSO accounts have no password until the user sets one.
+			now := time.Now()
+			id, err := r.CreateUser(ctx, repository.User{
+				Name:            name,
+				Email:           claims.Email,
+				Role:            string(policy.RoleAuthor),
+				EmailVerifiedAt: &now,
+			})
+			if err != nil {
+				return fmt.Errorf("error register: %w", err)
+			}
+			userID = id
+		}
+
+		return r.CreateUserIdentity(ctx, repository.UserIdentity{
+			Issuer:  claims.Issuer,
+			Subject: claims.Subject,
+			UserID:  userID,
+		})
+	})
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	if takenOver {
+		err = s.RevokeAllSessions(ctx, userID)
+		if err != nil {
+			return Credentials{}, err
+		}
+	}
+
+	u := repository.New(s.db).User(ctx, userID)
+	if u == nil {
+		return Credentials{}, fmt.Errorf("user with id %d: %w", userID, ErrNotFound)
+	}
+	return s.completeLogin(ctx, u, client)
+}
+
+// resetCredentials removes every way of signing in to the account: the
+// password, two-factor authentication, linked identities, passkeys, personal
+// access tokens and pending emailed tokens.
+func resetCredentials(ctx context.Context, r *repository.Repository, userID int) error {
+	err := r.UpdateUserPassword(ctx, userID, "")
+	if err != nil {
+		return err
+	}
+
+	err = r.UpdateUserTOTP(ctx, userID, nil, false)
+	if err != nil {
+		return err
+	}
+
+	deletes := []func(context.Context, int) error{
+		r.DeleteUserIdentities,
+		r.DeleteRecoveryCodes,
+		r.DeleteAllUserTokens,
+		r.DeleteUserPersonalAccessTokens,
+		r.DeleteUserWebAuthnCredentials,
+	}
+	for _, del := range deletes {
+		err := del(ctx, userID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package user
+
+import (
+	"html/template"
+	"log/slog"
+	"net/http"
+)
+
+// confirmPage is the page behind links in emails. Mail scanners and link
+// previews open such links on their own, so opening one changes nothing: the
+// page posts the token as JSON to Action once the user submits the form.
+var confirmPage = template.Must(template.New("confirm").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{.Message}}</p>
+<form method="post" action="{{.Action}}" data-done="{{.Done}}">
+<input type="hidden" name="token" value="{{.Token}}">
+{{if .Password}}<p><label>New password <input type="password" name="password" autocomplete="new-password" required></label></p>{{end}}
+<p><button type="submit">{{.Button}}</button></p>
+</form>
+<p id="result" role="status"></p>
+<script>
+document.querySelector("form").addEventListener("submit", async (event) => {
+	event.preventDefault();
+	const form = event.target;
+	const body = {token: form.token.value};
+	if (form.password) {
+		body.password = form.password.value;
+	}
+	const result = document.getElementById("result");
+	const resp = await fetch(form.action, {
+		method: "POST",
+		headers: {"Content-Type": "application/json"},
+		credentials: "same-origin",
+		body: JSON.stringify(body),
+	});
+	if (resp.ok) {
+		form.hidden = true;
+		result.textContent = form.dataset.done;
+		return;
+	}
+	const data = await resp.json().catch(() => ({}));
+	result.textContent = data.error || "Something went wrong (" + resp.status + ").";
+});
+</script>
+</body>
+</html>
+`))
+
+type confirmPageData struct {
+	Title   string
+	Message string
+	Button  string
+	Done    string
+	Action  string
+	Token   string
+	// Password asks for a new password along with the token.
+	Password bool
+}
+
+// writeConfirmPage renders confirmPage. The token is in the URL of the page,
+// so it must not leak to caches or through the Referer header.
+func writeConfirmPage(w http.ResponseWriter, data confirmPageData) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	err := confirmPage.Execute(w, data)
+	if err != nil {
+		slog.Error("failed to render page", "err", err)
+	}
+}
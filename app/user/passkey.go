@@ -0,0 +1,475 @@
+package user
+
+import (
+	"app/jwt"
+	"app/repository"
+	"app/server"
+	"app/session"
+	"app/webauthn"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrCredentialExists = errors.New("credential already registered")
+
+const (
+	passkeyRegisterAudience = "webauthn-register"
+	passkeyLoginAudience    = "webauthn-login"
+	passkeyChallengeTTL     = 5 * time.Minute
+)
+
+// passkeyChallengeClaims carry the challenge of a pending ceremony in a
+// signed token, so any app instance can finish it. Finishing records the
+// token ID so each challenge is answered once.
+type passkeyChallengeClaims struct {
+	jwt.Claims
+	Challenge string `json:"challenge"`
+}
+
+// Passkey is a registered WebAuthn credential as shown to its owner.
+type Passkey struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+// The options and credential types follow the JSON forms of the WebAuthn
+// API, with binary fields as base64url.
+type credentialParameter struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+type credentialDescriptor struct {
+	Type string         `json:"type"`
+	ID   webauthn.Bytes `json:"id"`
+}
+
+type creationOptions struct {
+	Challenge string `json:"challenge"`
+	RP        struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"rp"`
+	User struct {
+		ID          webauthn.Bytes `json:"id"`
+		Name        string         `json:"name"`
+		DisplayName string         `json:"displayName"`
+	} `json:"user"`
+	PubKeyCredParams       []credentialParameter  `json:"pubKeyCredParams"`
+	ExcludeCredentials     []credentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection struct {
+		ResidentKey      string `json:"residentKey"`
+		UserVerification string `json:"userVerification"`
+	} `json:"authenticatorSelection"`
+	Attestation string `json:"attestation"`
+	Timeout     int64  `json:"timeout"`
+}
+
+type requestOptions struct {
+	Challenge        string `json:"challenge"`
+	RPID             string `json:"rpId"`
+	UserVerification string `json:"userVerification"`
+	Timeout          int64  `json:"timeout"`
+}
+
+type PasskeyAttestation struct {
+	RawID    webauthn.Bytes `json:"rawId"`
+	Response struct {
+		ClientDataJSON    webauthn.Bytes `json:"clientDataJSON"`
+		AttestationObject webauthn.Bytes `json:"attestationObject"`
+	} `json:"response"`
+}
+
+type PasskeyAssertion struct {
+	RawID    webauthn.Bytes `json:"rawId"`
+	Response struct {
+		ClientDataJSON    webauthn.Bytes `json:"clientDataJSON"`
+		AuthenticatorData webauthn.Bytes `json:"authenticatorData"`
+		Signature         webauthn.Bytes `json:"signature"`
+		UserHandle        webauthn.Bytes `json:"userHandle"`
+	} `json:"response"`
+}
+
+func (s *Service) BeginPasskeyRegistrationHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input struct {
+			CurrentPassword  string `json:"current_password"`
+			ConfirmationCode string `json:"confirmation_code"`
+		}
+
+		err := json.NewDecoder(r.Body).Decode(&input)
+		if err != nil {
+			server.ErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		options, challengeToken, err := s.BeginPasskeyRegistration(r.Context(), IDFromContext(r.Context()),
+			input.CurrentPassword, input.ConfirmationCode, server.ClientIP(r))
+		if err != nil {
+			writeCredentialsError(w, err)
+			return
+		}
+
+		output := struct {
+			ChallengeToken string          `json:"challenge_token"`
+			PublicKey      creationOptions `json:"publicKey"`
+		}{
+			ChallengeToken: challengeToken,
+			PublicKey:      options,
+		}
+		server.JSONResponse(w, http.StatusOK, output)
+	}
+}
+
+// BeginPasskeyRegistration returns the options for
+// navigator.credentials.create() and a token to hand back on finish. Like
+// other sign in methods a passkey is only added after the user confirms
+// with their current password or a code from SendConfirmationCode, so a
+// stolen session cannot plant one.
+func (s *Service) BeginPasskeyRegistration(ctx context.Context, userID int, currentPassword, confirmationCode, ip string) (creationOptions, string, error) {
+	err := s.confirmUser(ctx, userID, currentPassword, confirmationCode, ip)
+	if err != nil {
+		return creationOptions{}, "", err
+	}
+
+	repo := repository.New(s.db)
+	u := repo.User(ctx, userID)
+	if u == nil {
+		return creationOptions{}, "", fmt.Errorf("user with id %d: %w", userID, ErrNotFound)
+	}
+
+	challenge, challengeToken, err := s.issuePasskeyChallenge(strconv.Itoa(u.ID), passkeyRegisterAudience)
+	if err != nil {
+		return creationOptions{}, "", err
+	}
+
+	var options creationOptions
+	options.Challenge = challenge
+	options.RP.ID = s.webauthn.ID()
+	options.RP.Name = s.webauthn.Name()
+	options.User.ID = webauthn.Bytes(strconv.Itoa(u.ID))
+	options.User.Name = u.Email
+	options.User.DisplayName = u.Name
+	options.PubKeyCredParams = []credentialParameter{
+		{Type: "public-key", Alg: webauthn.AlgES256},
+		{Type: "public-key", Alg: webauthn.AlgEdDSA},
+	}
+	options.ExcludeCredentials = []credentialDescriptor{}
+	for _, c := range repo.WebAuthnCredentials(ctx, u.ID) {
+		options.ExcludeCredentials = append(options.ExcludeCredentials, credentialDescriptor{
+			Type: "public-key",
+			ID:   c.CredentialID,
+		})
+	}
+	// Discoverable credentials let users sign in without typing an email.
+	options.AuthenticatorSelection.ResidentKey = "required"
+	options.AuthenticatorSelection.UserVerification = "preferred"
+	options.Attestation = "none"
+	options.Timeout = passkeyChallengeTTL.Milliseconds()
+	return options, challengeToken, nil
+}
+
+func (s *Service) FinishPasskeyRegistrationHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input struct {
+			ChallengeToken string             `json:"challenge_token"`
+			Name           string             `json:"name"`
+			Credential     PasskeyAttestation `json:"credential"`
+		}
+
+		err := json.NewDecoder(r.Body).Decode(&input)
+		if err != nil {
+			server.ErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		passkey, err := s.FinishPasskeyRegistration(r.Context(), IDFromContext(r.Context()),
+			input.ChallengeToken, input.Name, input.Credential)
+		if err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, ErrCredentialExists) {
+				status = http.StatusConflict
+			}
+			server.ErrorResponse(w, status, err)
+			return
+		}
+
+		server.JSONResponse(w, http.StatusCreated, passkey)
+	}
+}
+
+// FinishPasskeyRegistration verifies the new credential and stores it for
+// the user.
+func (s *Service) FinishPasskeyRegistration(ctx context.Context, userID int, challengeToken, name string, cred PasskeyAttestation) (Passkey, error) {
+	challenge, err := s.verifyPasskeyChallenge(challengeToken, passkeyRegisterAudience, strconv.Itoa(userID))
+	if err != nil {
+		return Passkey{}, err
+	}
+
+	c, err := s.webauthn.VerifyRegistration(challenge.Challenge, cred.Response.ClientDataJSON, cred.Response.AttestationObject)
+	if err != nil {
+		return Passkey{}, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = "Passkey"
+	}
+
+	data := repository.WebAuthnCredential{
+		UserID:       userID,
+		Name:         name,
+		CredentialID: c.ID,
+		PublicKey:    c.PublicKey,
+		SignCount:    c.SignCount,
+		CreatedAt:    time.Now(),
+	}
+	err = s.execInTx(ctx, func(r *repository.Repository) error {
+		err := s.usePasskeyChallenge(ctx, r, challenge)
+		if err != nil {
+			return err
+		}
+
+		data.ID, err = r.CreateWebAuthnCredential(ctx, data)
+		if repository.IsDuplicate(err) {
+			return ErrCredentialExists
+		}
+		if err != nil {
+			return fmt.Errorf("unable to store passkey: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return Passkey{}, err
+	}
+	return mapPasskeyRepoToService(data), nil
+}
+
+func (s *Service) PasskeysHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		output := struct {
+			Data []Passkey `json:"data"`
+		}{
+			Data: s.Passkeys(r.Context(), IDFromContext(r.Context())),
+		}
+		server.JSONResponse(w, http.StatusOK, output)
+	}
+}
+
+func (s *Service) Passkeys(ctx context.Context, userID int) []Passkey {
+	repo := repository.New(s.db)
+	creds := repo.WebAuthnCredentials(ctx, userID)
+
+	res := make([]Passkey, 0, len(creds))
+	for _, c := range creds {
+		res = append(res, mapPasskeyRepoToService(c))
+	}
+	return res
+}
+
+func (s *Service) DeletePasskeyHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			server.ErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		err = s.DeletePasskey(r.Context(), IDFromContext(r.Context()), id)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, ErrNotFound) {
+				status = http.StatusNotFound
+			}
+			server.ErrorResponse(w, status, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func (s *Service) DeletePasskey(ctx context.Context, userID, id int) error {
+	repo := repository.New(s.db)
+	n, err := repo.DeleteWebAuthnCredential(ctx, id, userID)
+	if err != nil {
+		return fmt.Errorf("unable to delete passkey %d: %w", id, err)
+	}
+	if n == 0 {
+		return fmt.Errorf("passkey with id %d: %w", id, ErrNotFound)
+	}
+	return nil
+}
+
+func (s *Service) BeginPasskeyLoginHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		challenge, challengeToken, err := s.issuePasskeyChallenge("", passkeyLoginAudience)
+		if err != nil {
+			server.ErrorResponse(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		output := struct {
+			ChallengeToken string         `json:"challenge_token"`
+			PublicKey      requestOptions `json:"publicKey"`
+		}{
+			ChallengeToken: challengeToken,
+			PublicKey: requestOptions{
+				Challenge:        challenge,
+				RPID:             s.webauthn.ID(),
+				UserVerification: "preferred",
+				Timeout:          passkeyChallengeTTL.Milliseconds(),
+			},
+		}
+		server.JSONResponse(w, http.StatusOK, output)
+	}
+}
+
+func (s *Service) FinishPasskeyLoginHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input struct {
+			ChallengeToken string           `json:"challenge_token"`
+			Credential     PasskeyAssertion `json:"credential"`
+		}
+
+		err := json.NewDecoder(r.Body).Decode(&input)
+		if err != nil {
+			server.ErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		creds, err := s.LoginWithPasskey(r.Context(), input.ChallengeToken, input.Credential, clientFromRequest(r))
+		if err != nil {
+			status := http.StatusInternalServerError
+			switch {
+			case errors.Is(err, ErrInvalidLogin), errors.Is(err, ErrInvalidToken):
+				status = http.StatusUnauthorized
+			case errors.Is(err, ErrAccountSuspended):
+				status = http.StatusForbidden
+			}
+			server.ErrorResponse(w, status, err)
+			return
+		}
+
+		s.writeCredentials(w, r, creds, cookieMode(r))
+	}
+}
+
+// LoginWithPasskey signs in with an assertion of a discoverable credential.
+// An assertion with user verification counts as two factors, otherwise a
+// second factor is still asked for when enabled.
+func (s *Service) LoginWithPasskey(ctx context.Context, challengeToken string, cred PasskeyAssertion, client session.Client) (Credentials, error) {
+	challenge, err := s.verifyPasskeyChallenge(challengeToken, passkeyLoginAudience, "")
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	var u *repository.User
+	var assertion webauthn.Assertion
+	err = s.execInTx(ctx, func(r *repository.Repository) error {
+		r.ForUpdate = true
+		err := s.usePasskeyChallenge(ctx, r, challenge)
+		if err != nil {
+			return err
+		}
+
+		c := r.WebAuthnCredentialWithID(ctx, cred.RawID)
+		if c == nil {
+			return fmt.Errorf("unknown passkey: %w", ErrInvalidLogin)
+		}
+		if len(cred.Response.UserHandle) > 0 && string(cred.Response.UserHandle) != strconv.Itoa(c.UserID) {
+			return fmt.Errorf("user handle mismatch: %w", ErrInvalidLogin)
+		}
+
+		assertion, err = s.webauthn.VerifyAssertion(challenge.Challenge, c.PublicKey, c.SignCount,
+			cred.Response.ClientDataJSON, cred.Response.AuthenticatorData, cred.Response.Signature)
+		if errors.Is(err, webauthn.ErrSignCount) {
+			slog.Warn("passkey sign count did not increase", "user_id", c.UserID, "passkey_id", c.ID)
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidLogin, err)
+		}
+
+		err = r.UpdateWebAuthnCredentialUse(ctx, c.ID, assertion.SignCount, time.Now())
+		if err != nil {
+			return err
+		}
+
+		u = r.User(ctx, c.UserID)
+		if u == nil {
+			return ErrInvalidLogin
+		}
+		return nil
+	})
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	if assertion.UserVerified {
+		return s.issueCredentials(ctx, u.ID, client)
+	}
+	return s.completeLogin(ctx, u, client)
+}
+
+func (s *Service) issuePasskeyChallenge(subject, audience string) (string, string, error) {
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		return "", "", err
+	}
+
+	claims := passkeyChallengeClaims{
+		Claims:    s.signer.NewClaims(subject, audience, passkeyChallengeTTL),
+		Challenge: challenge,
+	}
+	token, err := s.signer.Sign(claims)
+	if err != nil {
+		return "", "", fmt.Errorf("unable to sign passkey challenge: %w", err)
+	}
+	return challenge, token, nil
+}
+
+func (s *Service) verifyPasskeyChallenge(token, audience, subject string) (passkeyChallengeClaims, error) {
+	var claims passkeyChallengeClaims
+	err := s.signer.Verify(token, audience, &claims)
+	if err != nil {
+		return passkeyChallengeClaims{}, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if claims.Subject != subject {
+		return passkeyChallengeClaims{}, fmt.Errorf("%w: challenge issued to someone else", ErrInvalidToken)
+	}
+	return claims, nil
+}
+
+// usePasskeyChallenge marks the challenge as answered. Synced passkeys
+// always report a sign count of zero, so without this a captured response
+// could be replayed for as long as the challenge token is valid.
+func (s *Service) usePasskeyChallenge(ctx context.Context, r *repository.Repository, claims passkeyChallengeClaims) error {
+	err := r.DeleteExpiredWebAuthnChallenges(ctx, time.Now())
+	if err != nil {
+		return err
+	}
+
+	err = r.UseWebAuthnChallenge(ctx, claims.ID, time.Unix(claims.ExpiresAt, 0))
+	if repository.IsDuplicate(err) {
+		return fmt.Errorf("%w: challenge already used", ErrInvalidToken)
+	}
+	return err
+}
+
+func mapPasskeyRepoToService(data repository.WebAuthnCredential) Passkey {
+	return Passkey{
+		ID:         data.ID,
+		Name:       data.Name,
+		CreatedAt:  data.CreatedAt,
+		LastUsedAt: data.LastUsedAt,
+	}
+}
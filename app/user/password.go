@@ -0,0 +1,234 @@
+package user
+
+import (
+	"app/mailer"
+	"app/repository"
+	"app/server"
+	"app/session"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	purposePasswordReset = "password_reset"
+	passwordResetTTL     = time.Hour
+)
+
+func (s *Service) ForgotPasswordHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input struct {
+			Email string `json:"email"`
+		}
+
+		err := json.NewDecoder(r.Body).Decode(&input)
+		if err != nil {
+			server.ErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		// Apart from throttling the outcome is not reported so the
+		// endpoint cannot be used to probe which emails are registered.
+		err = s.ForgotPassword(r.Context(), input.Email, server.ClientIP(r))
+		if writeLocked(w, err) {
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// ForgotPassword emails a single use password reset link to email if it
+// belongs to a user. Requests are limited per email and per client IP
+// whether or not the email is known, and the email is sent in the
+// background.
+func (s *Service) ForgotPassword(ctx context.Context, email, ip string) error {
+	err := limitMail(s.mailLimiter, "reset:"+emailThrottleKey(email), "reset:ip:"+ip)
+	if err != nil {
+		return err
+	}
+
+	sendInBackground(ctx, "password reset", func(ctx context.Context) error {
+		return s.sendPasswordReset(ctx, email)
+	})
+	return nil
+}
+
+// sendPasswordReset sends the reset link. Earlier unused links of the user
+// stop working.
+func (s *Service) sendPasswordReset(ctx context.Context, email string) error {
+	repo := repository.New(s.db)
+	u := repo.UserWithEmail(ctx, email)
+	if u == nil {
+		return nil
+	}
+
+	token, err := s.createUserToken(ctx, repo, u.ID, purposePasswordReset, passwordResetTTL)
+	if err != nil {
+		return fmt.Errorf("unable to create reset token: %w", err)
+	}
+
+	link := s.baseURL + "/password/reset?token=" + url.QueryEscape(token)
+	return s.mailer.Send(ctx, mailer.Message{
+		To:      u.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\nUse the link below to choose a new password. It expires in %s.\n\n%s\n\n"+
+			"If you did not ask for a password reset you can ignore this email.\n",
+			u.Name, passwordResetTTL, link),
+	})
+}
+
+// ResetPasswordPageHandler serves the page the emailed reset link opens.
+func (s *Service) ResetPasswordPageHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeConfirmPage(w, confirmPageData{
+			Title:    "Reset your password",
+			Message:  "Choose a new password. You will be signed out everywhere.",
+			Button:   "Set password",
+			Done:     "Your password was changed, you can sign in with it now.",
+			Action:   "/password/reset",
+			Token:    r.URL.Query().Get("token"),
+			Password: true,
+		})
+	}
+}
+
+func (s *Service) ResetPasswordHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input struct {
+			Token    string `json:"token"`
+			Password string `json:"password"`
+		}
+
+		err := json.NewDecoder(r.Body).Decode(&input)
+		if err != nil {
+			server.ErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		err = s.ResetPassword(r.Context(), input.Token, input.Password)
+		if err != nil {
+			status := http.StatusUnprocessableEntity
+			if errors.Is(err, ErrInvalidToken) {
+				status = http.StatusBadRequest
+			}
+			server.ErrorResponse(w, status, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// ResetPassword sets a new password using a reset token and signs the user
+// out everywhere.
+func (s *Service) ResetPassword(ctx context.Context, token, password string) error {
+	if err := s.validatePassword(password); err != nil {
+		return err
+	}
+
+	var userID int
+	err := s.execInTx(ctx, func(r *repository.Repository) error {
+		r.ForUpdate = true
+		ut, err := s.useUserToken(ctx, r, token, purposePasswordReset)
+		if err != nil {
+			return err
+		}
+		userID = ut.UserID
+
+		passwordHash, err := s.hasher.Hash(password)
+		if err != nil {
+			return fmt.Errorf("error reset password: %w", err)
+		}
+		return r.UpdateUserPassword(ctx, userID, passwordHash)
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.RevokeAllSessions(ctx, userID)
+}
+
+// createUserToken stores a new single use token for purpose, replacing the
+// user's earlier tokens for the same purpose, and returns the plain token.
+func (s *Service) createUserToken(ctx context.Context, r *repository.Repository, userID int, purpose string, ttl time.Duration) (string, error) {
+	token, err := session.NewToken()
+	if err != nil {
+		return "", err
+	}
+
+	err = r.DeleteUserTokens(ctx, userID, purpose)
+	if err != nil {
+		return "", err
+	}
+
+	err = r.CreateUserToken(ctx, repository.UserToken{
+		TokenHash: session.HashToken(token),
+		UserID:    userID,
+		Purpose:   purpose,
+		ExpiresAt: time.Now().Add(ttl),
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// useUserToken redeems a token created by createUserToken. It must run in a
+// transaction with r.ForUpdate set so a token cannot be redeemed twice.
+func (s *Service) useUserToken(ctx context.Context, r *repository.Repository, token, purpose string) (*repository.UserToken, error) {
+	ut := r.UserToken(ctx, session.HashToken(token), purpose)
+	if ut == nil || ut.UsedAt != nil {
+		return nil, ErrInvalidToken
+	}
+	if !time.Now().Before(ut.ExpiresAt) {
+		return nil, fmt.Errorf("%w: token expired", ErrInvalidToken)
+	}
+
+	err := r.MarkUserTokenUsed(ctx, ut.TokenHash, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return ut, nil
+}
+
+// validatePassword checks password against the configured policy.
+func (s *Service) validatePassword(password string) error {
+	problems := s.passwordPolicy.Validate(password)
+	if len(problems) > 0 {
+		return server.FieldErrors{"password": strings.Join(problems, ", ")}
+	}
+	return nil
+}
+
+// checkPassword verifies password against the hash of u, upgrading the hash
+// when it was made with an outdated algorithm or cost. A nil u is checked
+// against a dummy hash so unknown users take as long as wrong passwords.
+func (s *Service) checkPassword(ctx context.Context, u *repository.User, password string) bool {
+	if u == nil {
+		s.hasher.Verify(s.dummyHash(), password)
+		return false
+	}
+
+	ok, needsRehash := s.hasher.Verify(u.PasswordHash, password)
+	if !ok {
+		return false
+	}
+
+	if needsRehash {
+		passwordHash, err := s.hasher.Hash(password)
+		if err == nil {
+			err = repository.New(s.db).UpdateUserPassword(ctx, u.ID, passwordHash)
+		}
+		if err != nil {
+			slog.Error("failed to upgrade password hash", "user_id", u.ID, "err", err)
+		}
+	}
+	return true
+}
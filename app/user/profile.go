@@ -0,0 +1,202 @@
+package user
+
+import (
+	"app/repository"
+	"app/server"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const maxBioLength = 1000
+
+// Profile is the signed in user's own view of their account.
+type Profile struct {
+	ID               int       `json:"id"`
+	Name             string    `json:"name"`
+	Email            string    `json:"email"`
+	EmailVerified    bool      `json:"email_verified"`
+	Role             string    `json:"role"`
+	TwoFactorEnabled bool      `json:"two_factor_enabled"`
+	Bio              string    `json:"bio"`
+	AvatarURL        string    `json:"avatar_url"`
+	Website          string    `json:"website"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+// PublicProfile is what anyone may see about an author.
+type PublicProfile struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	Bio       string    `json:"bio"`
+	AvatarURL string    `json:"avatar_url"`
+	Website   string    `json:"website"`
+	PostCount int       `json:"post_count"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type ProfileInput struct {
+	Name      string `json:"name"`
+	Bio       string `json:"bio"`
+	AvatarURL string `json:"avatar_url"`
+	Website   string `json:"website"`
+}
+
+func (s *Service) MeHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := s.Me(r.Context(), IDFromContext(r.Context()))
+		if p == nil {
+			server.ErrorResponse(w, http.StatusNotFound, ErrNotFound)
+			return
+		}
+
+		server.JSONResponse(w, http.StatusOK, p)
+	}
+}
+
+func (s *Service) Me(ctx context.Context, userID int) *Profile {
+	repo := repository.New(s.db)
+	u := repo.User(ctx, userID)
+	if u == nil {
+		return nil
+	}
+
+	res := mapProfileRepoToService(*u)
+	return &res
+}
+
+func (s *Service) UpdateMeHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input ProfileInput
+		err := json.NewDecoder(r.Body).Decode(&input)
+		if err != nil {
+			server.ErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		p, err := s.UpdateProfile(r.Context(), IDFromContext(r.Context()), input)
+		if err != nil {
+			status := http.StatusInternalServerError
+			var fields server.FieldErrors
+			switch {
+			case errors.As(err, &fields):
+				status = http.StatusUnprocessableEntity
+			case errors.Is(err, ErrNotFound):
+				status = http.StatusNotFound
+			}
+			server.ErrorResponse(w, status, err)
+			return
+		}
+
+		server.JSONResponse(w, http.StatusOK, p)
+	}
+}
+
+func (s *Service) UpdateProfile(ctx context.Context, userID int, input ProfileInput) (*Profile, error) {
+	input.Name = strings.TrimSpace(input.Name)
+	input.AvatarURL = strings.TrimSpace(input.AvatarURL)
+	input.Website = strings.TrimSpace(input.Website)
+
+	fields := server.FieldErrors{}
+	if input.Name == "" {
+		fields["name"] = "is required"
+	}
+	if utf8.RuneCountInString(input.Bio) > maxBioLength {
+		fields["bio"] = fmt.Sprintf("must be at most %d characters", maxBioLength)
+	}
+	if input.AvatarURL != "" && !validWebURL(input.AvatarURL) {
+		fields["avatar_url"] = "must be an http or https URL"
+	}
+	if input.Website != "" && !validWebURL(input.Website) {
+		fields["website"] = "must be an http or https URL"
+	}
+	if len(fields) > 0 {
+		return nil, fields
+	}
+
+	var res Profile
+	err := s.execInTx(ctx, func(r *repository.Repository) error {
+		r.ForUpdate = true
+		u := r.User(ctx, userID)
+		if u == nil {
+			return fmt.Errorf("user with id %d: %w", userID, ErrNotFound)
+		}
+
+		u.Name = input.Name
+		u.Bio = input.Bio
+		u.AvatarURL = input.AvatarURL
+		u.Website = input.Website
+		res = mapProfileRepoToService(*u)
+		return r.UpdateUserProfile(ctx, u.ID, *u)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func (s *Service) PublicProfileHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			server.ErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		p := s.PublicProfile(r.Context(), id)
+		if p == nil {
+			server.ErrorResponse(w, http.StatusNotFound, ErrNotFound)
+			return
+		}
+
+		server.JSONResponse(w, http.StatusOK, p)
+	}
+}
+
+func (s *Service) PublicProfile(ctx context.Context, userID int) *PublicProfile {
+	repo := repository.New(s.db)
+	u := repo.User(ctx, userID)
+	if u == nil {
+		return nil
+	}
+
+	return &PublicProfile{
+		ID:        u.ID,
+		Name:      u.Name,
+		Bio:       u.Bio,
+		AvatarURL: u.AvatarURL,
+		Website:   u.Website,
+		PostCount: repo.CountPublishedPostsByAuthor(ctx, u.ID),
+		CreatedAt: u.CreatedAt,
+	}
+}
+
+func validWebURL(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+func mapProfileRepoToService(data repository.User) Profile {
+	return Profile{
+		ID:               data.ID,
+		Name:             data.Name,
+		Email:            data.Email,
+		EmailVerified:    data.EmailVerifiedAt != nil,
+		Role:             data.Role,
+		TwoFactorEnabled: data.TOTPEnabled,
+		Bio:              data.Bio,
+		AvatarURL:        data.AvatarURL,
+		Website:          data.Website,
+		CreatedAt:        data.CreatedAt,
+	}
+}
@@ -0,0 +1,97 @@
+package user
+
+import (
+	"app/server"
+	"app/session"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// ActiveSession is a signed in device as shown to its owner.
+type ActiveSession struct {
+	ID         string    `json:"id"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current"`
+}
+
+func (s *Service) SessionsHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		sessions, err := s.Sessions(ctx, IDFromContext(ctx), TokenFromContext(ctx))
+		if err != nil {
+			server.ErrorResponse(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		output := struct {
+			Sessions []ActiveSession `json:"sessions"`
+		}{
+			Sessions: sessions,
+		}
+		server.JSONResponse(w, http.StatusOK, output)
+	}
+}
+
+// Sessions lists the live sessions of the user, marking the one that
+// currentToken belongs to.
+func (s *Service) Sessions(ctx context.Context, userID int, currentToken string) ([]ActiveSession, error) {
+	list, err := s.sessions.List(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list sessions of user %d: %w", userID, err)
+	}
+
+	// Requests authenticated with an access token have no current
+	// session.
+	var currentID string
+	if current, err := s.sessions.Get(ctx, currentToken); err == nil {
+		currentID = current.ID
+	}
+
+	res := make([]ActiveSession, 0, len(list))
+	for _, sess := range list {
+		res = append(res, ActiveSession{
+			ID:         sess.ID,
+			IP:         sess.IP,
+			UserAgent:  sess.UserAgent,
+			CreatedAt:  sess.CreatedAt,
+			LastSeenAt: sess.LastSeenAt,
+			ExpiresAt:  sess.ExpiresAt,
+			Current:    sess.ID == currentID,
+		})
+	}
+	return res, nil
+}
+
+func (s *Service) RevokeSessionHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := s.RevokeSession(r.Context(), IDFromContext(r.Context()), r.PathValue("id"))
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, ErrNotFound) {
+				status = http.StatusNotFound
+			}
+			server.ErrorResponse(w, status, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func (s *Service) RevokeSession(ctx context.Context, userID int, id string) error {
+	err := s.sessions.DeleteByID(ctx, userID, id)
+	if errors.Is(err, session.ErrNotFound) {
+		return fmt.Errorf("session %s: %w", id, ErrNotFound)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to revoke session %s: %w", id, err)
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package user
+
+import (
+	"app/server"
+	"app/throttle"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrTooManyAttempts = errors.New("too many failed attempts")
+
+// AccountThrottle and IPThrottle are the default penalties for failed
+// logins per account and per client IP. The IP limit is looser since many
+// users may share an address.
+var (
+	AccountThrottle = throttle.Config{
+		FreeAttempts:    5,
+		BaseDelay:       time.Second,
+		MaxDelay:        5 * time.Minute,
+		LockoutAfter:    10,
+		LockoutDuration: 15 * time.Minute,
+		ForgetAfter:     time.Hour,
+	}
+	IPThrottle = throttle.Config{
+		FreeAttempts:    20,
+		BaseDelay:       time.Second,
+		MaxDelay:        5 * time.Minute,
+		LockoutAfter:    100,
+		LockoutDuration: time.Hour,
+		ForgetAfter:     time.Hour,
+	}
+	// MagicLinkThrottle counts every magic link request, not only failed
+	// ones, so that the endpoint cannot be used to flood an inbox.
+	MagicLinkThrottle = throttle.Config{
+		FreeAttempts: 3,
+		BaseDelay:    time.Minute,
+		MaxDelay:     15 * time.Minute,
+		ForgetAfter:  time.Hour,
+	}
+	// MailThrottle likewise limits password reset and verification emails.
+	MailThrottle = throttle.Config{
+		FreeAttempts: 3,
+		BaseDelay:    time.Minute,
+		MaxDelay:     15 * time.Minute,
+		ForgetAfter:  time.Hour,
+	}
+)
+
+// LockedError is returned while an account or client is locked out.
+type LockedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("%v, retry in %s", ErrTooManyAttempts, e.RetryAfter.Round(time.Second))
+}
+
+func (e *LockedError) Unwrap() error {
+	return ErrTooManyAttempts
+}
+
+// attempt counts an attempt against the account key and the client IP
+// before the credentials are checked, returning a LockedError if either is
+// blocked. Every attempt counts as failed until succeeded or refundAttempt
+// hands it back.
+func (s *Service) attempt(accountKey, ip string) error {
+	now := time.Now()
+	if d, ok := s.accountLimiter.Attempt(accountKey, now); !ok {
+		return &LockedError{RetryAfter: d}
+	}
+	if d, ok := s.ipLimiter.Attempt(ip, now); !ok {
+		s.accountLimiter.Refund(accountKey)
+		return &LockedError{RetryAfter: d}
+	}
+	return nil
+}
+
+// succeeded forgets the failures of the account key after the credentials
+// checked out and refunds the attempt of the client IP.
+func (s *Service) succeeded(accountKey, ip string) {
+	s.accountLimiter.Reset(accountKey)
+	s.ipLimiter.Refund(ip)
+}
+
+// refundAttempt hands back an attempt that failed for reasons other than
+// wrong credentials.
+func (s *Service) refundAttempt(accountKey, ip string) {
+	s.accountLimiter.Refund(accountKey)
+	s.ipLimiter.Refund(ip)
+}
+
+func emailThrottleKey(email string) string {
+	return "email:" + normalizeEmail(email)
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func twoFactorThrottleKey(userID int) string {
+	return "2fa:" + strconv.Itoa(userID)
+}
+
+func reauthThrottleKey(userID int) string {
+	return "reauth:" + strconv.Itoa(userID)
+}
+
+// writeLocked responds with 429 and a Retry-After header if err is a
+// LockedError and reports whether it did.
+func writeLocked(w http.ResponseWriter, err error) bool {
+	var locked *LockedError
+	if !errors.As(err, &locked) {
+		return false
+	}
+
+	seconds := int(math.Ceil(locked.RetryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	server.ErrorResponse(w, http.StatusTooManyRequests, err)
+	return true
+}
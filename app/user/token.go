@@ -0,0 +1,204 @@
+package user
+
+import (
+	"app/repository"
+	"app/server"
+	"app/session"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Scopes that can be granted to personal access tokens. Session and access
+// tokens implicitly carry every scope.
+const (
+	ScopePostsWrite       = "posts:write"
+	ScopeCommentsModerate = "comments:moderate"
+)
+
+var validScopes = []string{ScopePostsWrite, ScopeCommentsModerate}
+
+// personalTokenPrefix marks personal access tokens so the middleware can tell
+// them apart from session tokens without a lookup.
+const personalTokenPrefix = "pat_"
+
+var ErrInvalidScope = errors.New("invalid scope")
+
+type PersonalAccessToken struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	Token      string     `json:"token,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+func (t PersonalAccessToken) HasScope(scope string) bool {
+	return slices.Contains(t.Scopes, scope)
+}
+
+func (s *Service) CreatePersonalAccessTokenHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input struct {
+			Name      string     `json:"name"`
+			Scopes    []string   `json:"scopes"`
+			ExpiresAt *time.Time `json:"expires_at"`
+		}
+
+		err := json.NewDecoder(r.Body).Decode(&input)
+		if err != nil {
+			server.ErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		pat, err := s.CreatePersonalAccessToken(r.Context(), IDFromContext(r.Context()), input.Name, input.Scopes, input.ExpiresAt)
+		if err != nil {
+			server.ErrorResponse(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+
+		server.JSONResponse(w, http.StatusCreated, pat)
+	}
+}
+
+// CreatePersonalAccessToken issues a token for userID. The plain token is
+// only returned here, it is stored hashed.
+func (s *Service) CreatePersonalAccessToken(ctx context.Context, userID int, name string, scopes []string, expiresAt *time.Time) (PersonalAccessToken, error) {
+	if strings.TrimSpace(name) == "" {
+		return PersonalAccessToken{}, errors.New("token name is required")
+	}
+	if len(scopes) == 0 {
+		return PersonalAccessToken{}, fmt.Errorf("at least one scope is required: %w", ErrInvalidScope)
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(validScopes, scope) {
+			return PersonalAccessToken{}, fmt.Errorf("scope %q: %w", scope, ErrInvalidScope)
+		}
+	}
+	if expiresAt != nil && !expiresAt.After(time.Now()) {
+		return PersonalAccessToken{}, errors.New("token expiry must be in the future")
+	}
+
+	token, err := session.NewToken()
+	if err != nil {
+		return PersonalAccessToken{}, fmt.Errorf("unable to generate token: %w", err)
+	}
+	token = personalTokenPrefix + token
+
+	repo := repository.New(s.db)
+	id, err := repo.CreatePersonalAccessToken(ctx, repository.PersonalAccessToken{
+		UserID:    userID,
+		Name:      name,
+		TokenHash: session.HashToken(token),
+		Scopes:    strings.Join(scopes, " "),
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		return PersonalAccessToken{}, fmt.Errorf("unable to create token: %w", err)
+	}
+
+	return PersonalAccessToken{
+		ID:        id,
+		Name:      name,
+		Scopes:    scopes,
+		Token:     token,
+		CreatedAt: time.Now(),
+		ExpiresAt: expiresAt,
+	}, nil
+}
+
+func (s *Service) PersonalAccessTokensHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pats := s.PersonalAccessTokens(r.Context(), IDFromContext(r.Context()))
+
+		output := struct {
+			Data []PersonalAccessToken `json:"data"`
+		}{
+			Data: pats,
+		}
+		server.JSONResponse(w, http.StatusOK, output)
+	}
+}
+
+func (s *Service) PersonalAccessTokens(ctx context.Context, userID int) []PersonalAccessToken {
+	repo := repository.New(s.db)
+	pats := repo.PersonalAccessTokens(ctx, userID)
+
+	res := make([]PersonalAccessToken, 0, len(pats))
+	for _, p := range pats {
+		res = append(res, mapPersonalAccessTokenRepoToService(p))
+	}
+	return res
+}
+
+func (s *Service) RevokePersonalAccessTokenHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			server.ErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		err = s.RevokePersonalAccessToken(r.Context(), IDFromContext(r.Context()), id)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, ErrNotFound) {
+				status = http.StatusNotFound
+			}
+			server.ErrorResponse(w, status, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func (s *Service) RevokePersonalAccessToken(ctx context.Context, userID, id int) error {
+	repo := repository.New(s.db)
+	n, err := repo.DeletePersonalAccessToken(ctx, id, userID)
+	if err != nil {
+		return fmt.Errorf("unable to revoke token %d: %w", id, err)
+	}
+	if n == 0 {
+		return fmt.Errorf("token with id %d: %w", id, ErrNotFound)
+	}
+	return nil
+}
+
+// personalAccessToken resolves a plain personal access token, rejecting
+// expired ones.
+func (s *Service) personalAccessToken(ctx context.Context, token string) (int, PersonalAccessToken, error) {
+	repo := repository.New(s.db)
+	p := repo.PersonalAccessTokenWithHash(ctx, session.HashToken(token))
+	if p == nil {
+		return 0, PersonalAccessToken{}, ErrInvalidToken
+	}
+	if p.ExpiresAt != nil && !time.Now().Before(*p.ExpiresAt) {
+		return 0, PersonalAccessToken{}, fmt.Errorf("%w: token expired", ErrInvalidToken)
+	}
+
+	err := repo.TouchPersonalAccessToken(ctx, p.ID, time.Now())
+	if err != nil {
+		slog.Error("failed to touch personal access token", "id", p.ID, "err", err)
+	}
+	return p.UserID, mapPersonalAccessTokenRepoToService(*p), nil
+}
+
+func mapPersonalAccessTokenRepoToService(data repository.PersonalAccessToken) PersonalAccessToken {
+	return PersonalAccessToken{
+		ID:         data.ID,
+		Name:       data.Name,
+		Scopes:     strings.Fields(data.Scopes),
+		CreatedAt:  data.CreatedAt,
+		ExpiresAt:  data.ExpiresAt,
+		LastUsedAt: data.LastUsedAt,
+	}
+}
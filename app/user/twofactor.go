@@ -0,0 +1,288 @@
+package user
+
+import (
+	"app/jwt"
+	"app/repository"
+	"app/server"
+	"app/session"
+	"app/totp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrTwoFactorEnabled    = errors.New("two-factor authentication already enabled")
+	ErrTwoFactorNotEnabled = errors.New("two-factor authentication not enrolled")
+	ErrInvalidCode         = errors.New("invalid code")
+)
+
+const (
+	twoFactorAudience     = "2fa-challenge"
+	twoFactorChallengeTTL = 5 * time.Minute
+	recoveryCodeCount     = 10
+)
+
+func (s *Service) EnrollTwoFactorHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		secret, uri, err := s.EnrollTwoFactor(r.Context(), IDFromContext(r.Context()))
+		if err != nil {
+			status := http.StatusInternalServerError
+			switch {
+			case errors.Is(err, ErrTwoFactorEnabled):
+				status = http.StatusConflict
+			case errors.Is(err, ErrNotFound):
+				status = http.StatusNotFound
+			}
+			server.ErrorResponse(w, status, err)
+			return
+		}
+
+		output := struct {
+			Secret     string `json:"secret"`
+			OTPAuthURL string `json:"otpauth_url"`
+		}{
+			Secret:     secret,
+			OTPAuthURL: uri,
+		}
+		server.JSONResponse(w, http.StatusOK, output)
+	}
+}
+
+// EnrollTwoFactor generates a new TOTP secret for userID. Two-factor login is
+// only enforced once the secret is confirmed with ConfirmTwoFactor.
+func (s *Service) EnrollTwoFactor(ctx context.Context, userID int) (string, string, error) {
+	var secret, uri string
+	err := s.execInTx(ctx, func(r *repository.Repository) error {
+		r.ForUpdate = true
+		u := r.User(ctx, userID)
+		if u == nil {
+			return fmt.Errorf("user with id %d: %w", userID, ErrNotFound)
+		}
+		if u.TOTPEnabled {
+			return ErrTwoFactorEnabled
+		}
+
+		var err error
+		secret, err = totp.GenerateSecret()
+		if err != nil {
+			return err
+		}
+		uri = totp.URI(s.totpIssuer, u.Email, secret)
+
+		return r.UpdateUserTOTP(ctx, u.ID, &secret, false)
+	})
+
+	return secret, uri, err
+}
+
+func (s *Service) ConfirmTwoFactorHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input struct {
+			Code string `json:"code"`
+		}
+
+		err := json.NewDecoder(r.Body).Decode(&input)
+		if err != nil {
+			server.ErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		codes, err := s.ConfirmTwoFactor(r.Context(), IDFromContext(r.Context()), input.Code)
+		if err != nil {
+			status := http.StatusInternalServerError
+			switch {
+			case errors.Is(err, ErrTwoFactorEnabled):
+				status = http.StatusConflict
+			case errors.Is(err, ErrTwoFactorNotEnabled), errors.Is(err, ErrInvalidCode):
+				status = http.StatusUnprocessableEntity
+			}
+			server.ErrorResponse(w, status, err)
+			return
+		}
+
+		output := struct {
+			RecoveryCodes []string `json:"recovery_codes"`
+		}{
+			RecoveryCodes: codes,
+		}
+		server.JSONResponse(w, http.StatusOK, output)
+	}
+}
+
+// ConfirmTwoFactor enables two-factor login once code proves the user's
+// authenticator holds the enrolled secret, and returns fresh recovery codes.
+func (s *Service) ConfirmTwoFactor(ctx context.Context, userID int, code string) ([]string, error) {
+	var codes []string
+	err := s.execInTx(ctx, func(r *repository.Repository) error {
+		r.ForUpdate = true
+		u := r.User(ctx, userID)
+		if u == nil {
+			return fmt.Errorf("user with id %d: %w", userID, ErrNotFound)
+		}
+		if u.TOTPEnabled {
+			return ErrTwoFactorEnabled
+		}
+		if u.TOTPSecret == nil {
+			return ErrTwoFactorNotEnabled
+		}
+
+		step, ok := totp.Verify(*u.TOTPSecret, code, time.Now(), u.TOTPLastStep)
+		if !ok {
+			return ErrInvalidCode
+		}
+
+		err := r.UpdateUserTOTP(ctx, u.ID, u.TOTPSecret, true)
+		if err != nil {
+			return err
+		}
+		err = r.UpdateUserTOTPLastStep(ctx, u.ID, step)
+		if err != nil {
+			return err
+		}
+
+		codes, err = s.replaceRecoveryCodes(ctx, r, u.ID)
+		return err
+	})
+
+	return codes, err
+}
+
+func (s *Service) LoginTwoFactorHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input struct {
+			ChallengeToken string `json:"challenge_token"`
+			Code           string `json:"code"`
+			RecoveryCode   string `json:"recovery_code"`
+		}
+
+		err := json.NewDecoder(r.Body).Decode(&input)
+		if err != nil {
+			server.ErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		creds, err := s.LoginTwoFactor(r.Context(), input.ChallengeToken, input.Code, input.RecoveryCode, clientFromRequest(r))
+		if err != nil {
+			if writeLocked(w, err) {
+				return
+			}
+			status := http.StatusInternalServerError
+			switch {
+			case errors.Is(err, ErrInvalidToken), errors.Is(err, ErrInvalidCode):
+				status = http.StatusUnauthorized
+			case errors.Is(err, ErrAccountSuspended):
+				status = http.StatusForbidden
+			}
+			server.ErrorResponse(w, status, err)
+			return
+		}
+
+		s.writeCredentials(w, r, creds, cookieMode(r))
+	}
+}
+
+// LoginTwoFactor completes a login started by Login for a user with
+// two-factor authentication, using either a TOTP code or a recovery code.
+// Wrong codes are throttled like wrong passwords.
+func (s *Service) LoginTwoFactor(ctx context.Context, challenge, code, recoveryCode string, client session.Client) (Credentials, error) {
+	var claims jwt.Claims
+	err := s.signer.Verify(challenge, twoFactorAudience, &claims)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("%w: subject %q", ErrInvalidToken, claims.Subject)
+	}
+
+	accountKey := twoFactorThrottleKey(userID)
+	if err := s.attempt(accountKey, client.IP); err != nil {
+		return Credentials{}, err
+	}
+
+	err = s.execInTx(ctx, func(r *repository.Repository) error {
+		r.ForUpdate = true
+		u := r.User(ctx, userID)
+		if u == nil || !u.TOTPEnabled || u.TOTPSecret == nil {
+			return ErrInvalidToken
+		}
+
+		if recoveryCode != "" {
+			n, err := r.UseRecoveryCode(ctx, u.ID, hashRecoveryCode(recoveryCode), time.Now())
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				return ErrInvalidCode
+			}
+			return nil
+		}
+
+		step, ok := totp.Verify(*u.TOTPSecret, code, time.Now(), u.TOTPLastStep)
+		if !ok {
+			return ErrInvalidCode
+		}
+		return r.UpdateUserTOTPLastStep(ctx, u.ID, step)
+	})
+	if err != nil {
+		if !errors.Is(err, ErrInvalidCode) {
+			s.refundAttempt(accountKey, client.IP)
+		}
+		return Credentials{}, err
+	}
+	s.succeeded(accountKey, client.IP)
+
+	return s.issueCredentials(ctx, userID, client)
+}
+
+func (s *Service) issueTwoFactorChallenge(userID int) (string, time.Time, error) {
+	claims := s.signer.NewClaims(strconv.Itoa(userID), twoFactorAudience, twoFactorChallengeTTL)
+	token, err := s.signer.Sign(claims)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return token, time.Unix(claims.ExpiresAt, 0), nil
+}
+
+// replaceRecoveryCodes invalidates the recovery codes of userID and returns
+// a new set. Only their hashes are stored.
+func (s *Service) replaceRecoveryCodes(ctx context.Context, r *repository.Repository, userID int) ([]string, error) {
+	err := r.DeleteRecoveryCodes(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for range recoveryCodeCount {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := hex.EncodeToString(b)
+		code = code[:5] + "-" + code[5:]
+
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+
+	err = r.CreateRecoveryCodes(ctx, userID, hashes)
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	return session.HashToken(code)
+}
@@ -1,45 +1,197 @@
 package user
 
 import (
+	"app/jwt"
+	"app/mailer"
+	"app/oidc"
+	"app/passwd"
+	"app/policy"
 	"app/repository"
 	"app/server"
 	"app/session"
+	"app/throttle"
+	"app/webauthn"
 	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
-
-	"golang.org/x/crypto/bcrypt"
+	"net/mail"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 var (
 	ErrAlreadyRegistered = errors.New("already registered")
 	ErrInvalidLogin      = errors.New("invalid login")
+	ErrInvalidToken      = errors.New("invalid token")
 	ErrNotFound          = errors.New("not found")
+	ErrStatelessLogout   = errors.New("access tokens cannot be logged out, send the refresh token or revoke all sessions")
 )
 
+// accessTokenAudience is the "aud" claim of access tokens, keeping them apart
+// from other tokens signed with the same keys.
+const accessTokenAudience = "access"
+
 type User struct {
 	Name     string
 	Email    string
 	Password string
 }
 
+// Credentials are issued on login. Browser clients use the opaque session
+// token, stateless clients use the access token and renew it with the
+// refresh token. For users with two-factor authentication the password step
+// only yields TwoFactorChallenge, to be completed with LoginTwoFactor.
+type Credentials struct {
+	Session              session.Session
+	AccessToken          string
+	AccessTokenExpiresAt time.Time
+	RefreshToken         session.RefreshToken
+
+	TwoFactorChallenge          string
+	TwoFactorChallengeExpiresAt time.Time
+}
+
+type Config struct {
+	Sessions       session.Store
+	RefreshTokens  session.RefreshStore
+	Signer         *jwt.Signer
+	AccessTokenTTL time.Duration
+	// OIDC enables single sign-on when set.
+	OIDC *oidc.Provider
+	// CookieSecure marks cookies set by the service as HTTPS only.
+	CookieSecure bool
+	// TOTPIssuer is the account issuer shown in authenticator apps.
+	TOTPIssuer string
+	Mailer     mailer.Mailer
+	// BaseURL is the public URL of the app, used for links in emails.
+	BaseURL string
+	// AccountLimiter and IPLimiter throttle failed logins per account and
+	// per client IP.
+	AccountLimiter *throttle.Limiter
+	IPLimiter      *throttle.Limiter
+	// MagicLinkLimiter limits how often magic links are sent per email
+	// and per client IP.
+	MagicLinkLimiter *throttle.Limiter
+	// MailLimiter limits how often password reset and verification
+	// emails are sent.
+	MailLimiter *throttle.Limiter
+	// Hasher hashes new passwords, existing hashes are upgraded to it on
+	// login.
+	Hasher         *passwd.Hasher
+	PasswordPolicy *passwd.Policy
+	// WebAuthn enables passkey login when set.
+	WebAuthn *webauthn.RelyingParty
+	// Policy decides who may manage other users.
+	Policy *policy.Policy
+	// RegistrationMode decides who may register, RegistrationOpen by
+	// default.
+	RegistrationMode RegistrationMode
+	// DeletionMode is what happens to an account deleted by its owner,
+	// DeleteHard by default.
+	DeletionMode DeletionMode
+}
+
 type Service struct {
-	db *sql.DB
+	db               *sql.DB
+	sessions         session.Store
+	refreshTokens    session.RefreshStore
+	signer           *jwt.Signer
+	accessTokenTTL   time.Duration
+	oidc             *oidc.Provider
+	cookieSecure     bool
+	totpIssuer       string
+	mailer           mailer.Mailer
+	baseURL          string
+	accountLimiter   *throttle.Limiter
+	ipLimiter        *throttle.Limiter
+	magicLinkLimiter *throttle.Limiter
+	mailLimiter      *throttle.Limiter
+	hasher           *passwd.Hasher
+	passwordPolicy   passwd.Policy
+	webauthn         *webauthn.RelyingParty
+	policy           *policy.Policy
+	deletionMode     DeletionMode
+	registrationMode RegistrationMode
+	dummyHash        func() string
 }
 
-func NewService(db *sql.DB) *Service {
-	return &Service{db: db}
+func NewService(db *sql.DB, cfg Config) *Service {
+	if cfg.AccessTokenTTL <= 0 {
+		cfg.AccessTokenTTL = 15 * time.Minute
+	}
+	if cfg.TOTPIssuer == "" {
+		cfg.TOTPIssuer = "app"
+	}
+	if cfg.AccountLimiter == nil {
+		cfg.AccountLimiter = throttle.New(AccountThrottle)
+	}
+	if cfg.IPLimiter == nil {
+		cfg.IPLimiter = throttle.New(IPThrottle)
+	}
+	if cfg.MagicLinkLimiter == nil {
+		cfg.MagicLinkLimiter = throttle.New(MagicLinkThrottle)
+	}
+	if cfg.MailLimiter == nil {
+		cfg.MailLimiter = throttle.New(MailThrottle)
+	}
+	if cfg.Hasher == nil {
+		cfg.Hasher = passwd.NewHasher(passwd.Argon2id)
+	}
+	if cfg.PasswordPolicy == nil {
+		cfg.PasswordPolicy = &passwd.DefaultPolicy
+	}
+	if cfg.Policy == nil {
+		cfg.Policy = policy.New()
+	}
+	if cfg.RegistrationMode == "" {
+		cfg.RegistrationMode = RegistrationOpen
+	}
+	if cfg.DeletionMode == "" {
+		cfg.DeletionMode = DeleteHard
+	}
+
+	s := &Service{
+		db:               db,
+		sessions:         cfg.Sessions,
+		refreshTokens:    cfg.RefreshTokens,
+		signer:           cfg.Signer,
+		accessTokenTTL:   cfg.AccessTokenTTL,
+		oidc:             cfg.OIDC,
+		cookieSecure:     cfg.CookieSecure,
+		totpIssuer:       cfg.TOTPIssuer,
+		mailer:           cfg.Mailer,
+		baseURL:          strings.TrimSuffix(cfg.BaseURL, "/"),
+		accountLimiter:   cfg.AccountLimiter,
+		ipLimiter:        cfg.IPLimiter,
+		magicLinkLimiter: cfg.MagicLinkLimiter,
+		mailLimiter:      cfg.MailLimiter,
+		hasher:           cfg.Hasher,
+		passwordPolicy:   *cfg.PasswordPolicy,
+		webauthn:         cfg.WebAuthn,
+		policy:           cfg.Policy,
+		deletionMode:     cfg.DeletionMode,
+		registrationMode: cfg.RegistrationMode,
+	}
+	s.dummyHash = sync.OnceValue(func() string {
+		h, _ := s.hasher.Hash("not a real password")
+		return h
+	})
+	return s
 }
 
 func (s *Service) RegisterHandler() func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var input struct {
-			Name     string `json:"name"`
-			Email    string `json:"email"`
-			Password string `json:"password"`
+			Name       string `json:"name"`
+			Email      string `json:"email"`
+			Password   string `json:"password"`
+			InviteCode string `json:"invite_code"`
 		}
 
 		err := json.NewDecoder(r.Body).Decode(&input)
@@ -48,9 +200,16 @@ func (s *Service) RegisterHandler() func(w http.ResponseWriter, r *http.Request)
 			return
 		}
 
-		err = s.Register(r.Context(), input.Name, input.Email, input.Password)
+		err = s.Register(r.Context(), input.Name, input.Email, input.Password, input.InviteCode)
 		if err != nil {
-			server.ErrorResponse(w, http.StatusUnprocessableEntity, err)
+			status := http.StatusUnprocessableEntity
+			switch {
+			case errors.Is(err, ErrAlreadyRegistered):
+				status = http.StatusConflict
+			case errors.Is(err, ErrRegistrationClosed), errors.Is(err, ErrInvalidInvite):
+				status = http.StatusForbidden
+			}
+			server.ErrorResponse(w, status, err)
 			return
 		}
 
@@ -58,26 +217,73 @@ func (s *Service) RegisterHandler() func(w http.ResponseWriter, r *http.Request)
 	}
 }
 
-func (s *Service) Register(ctx context.Context, name, email, password string) error {
+// Register creates an unverified account and emails the user a link to
+// verify the address. An invite code is required in invite-only mode and,
+// when given, decides the role of the account.
+func (s *Service) Register(ctx context.Context, name, email, password, inviteCode string) error {
+	switch {
+	case s.registrationMode == RegistrationClosed:
+		return ErrRegistrationClosed
+	case s.registrationMode == RegistrationInvite && inviteCode == "":
+		return fmt.Errorf("%w: an invite code is required", ErrRegistrationClosed)
+	}
+
+	fields := server.FieldErrors{}
+	if strings.TrimSpace(name) == "" {
+		fields["name"] = "is required"
+	}
+	if _, err := mail.ParseAddress(email); err != nil {
+		fields["email"] = "is not a valid email address"
+	}
+	if problems := s.passwordPolicy.Validate(password); len(problems) > 0 {
+		fields["password"] = strings.Join(problems, ", ")
+	}
+	if len(fields) > 0 {
+		return fields
+	}
+
+	var userID int
 	err := s.execInTx(ctx, func(r *repository.Repository) error {
 		u := r.UserWithEmail(ctx, email)
 		if u != nil {
 			return fmt.Errorf("email %s: %w", email, ErrAlreadyRegistered)
 		}
 
-		passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		role := policy.RoleAuthor
+		if inviteCode != "" {
+			var err error
+			role, err = s.redeemInvite(ctx, r, inviteCode)
+			if err != nil {
+				return err
+			}
+		}
+
+		passwordHash, err := s.hasher.Hash(password)
 		if err != nil {
 			return fmt.Errorf("error register: %w", err)
 		}
 
-		return r.CreateUser(ctx, repository.User{
+		userID, err = r.CreateUser(ctx, repository.User{
 			Name:         name,
 			Email:        email,
-			PasswordHash: string(passwordHash),
+			PasswordHash: passwordHash,
+			Role:         string(role),
 		})
+		if repository.IsDuplicate(err) {
+			return fmt.Errorf("email %s: %w", email, ErrAlreadyRegistered)
+		}
+		return err
 	})
+	if err != nil {
+		return err
+	}
 
-	return err
+	// The account exists at this point, a failed email can be retried with
+	// the resend endpoint.
+	sendInBackground(ctx, "verification email", func(ctx context.Context) error {
+		return s.sendVerification(ctx, userID, name, email)
+	})
+	return nil
 }
 
 func (s *Service) LoginHandler() func(w http.ResponseWriter, r *http.Request) {
@@ -93,34 +299,390 @@ func (s *Service) LoginHandler() func(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		token, err := s.Login(r.Context(), input.Email, input.Password)
+		creds, err := s.Login(r.Context(), input.Email, input.Password, clientFromRequest(r))
 		if err != nil {
-			server.ErrorResponse(w, http.StatusUnprocessableEntity, err)
+			if writeLocked(w, err) {
+				return
+			}
+			status := http.StatusUnprocessableEntity
+			if errors.Is(err, ErrAccountSuspended) {
+				status = http.StatusForbidden
+			}
+			server.ErrorResponse(w, status, err)
 			return
 		}
 
+		s.writeCredentials(w, r, creds, cookieMode(r))
+	}
+}
+
+// writeCredentials responds with the credentials of a successful login, or
+// with the challenge when a second factor is still required. In cookie mode
+// the session goes into an HttpOnly cookie and only the CSRF token is
+// returned.
+func (s *Service) writeCredentials(w http.ResponseWriter, r *http.Request, creds Credentials, cookie bool) {
+	if creds.TwoFactorChallenge != "" {
+		output := struct {
+			TwoFactorRequired bool      `json:"two_factor_required"`
+			ChallengeToken    string    `json:"challenge_token"`
+			ExpiresAt         time.Time `json:"expires_at"`
+		}{
+			TwoFactorRequired: true,
+			ChallengeToken:    creds.TwoFactorChallenge,
+			ExpiresAt:         creds.TwoFactorChallengeExpiresAt,
+		}
+		server.JSONResponse(w, http.StatusOK, output)
+		return
+	}
+
+	if cookie {
+		// Browsers stay signed in through the cookie, the refresh token
+		// would only linger unused.
+		err := s.refreshTokens.Delete(r.Context(), creds.RefreshToken.Token)
+		if err != nil {
+			slog.Error("failed to revoke refresh token", "err", err)
+		}
+
+		s.setSessionCookie(w, creds.Session.Token, creds.Session.ExpiresAt)
 		output := struct {
-			Token string `json:"token"`
+			CSRFToken     string    `json:"csrf_token"`
+			ExpiresAt     time.Time `json:"expires_at"`
+			IdleExpiresAt time.Time `json:"idle_expires_at"`
 		}{
-			Token: token,
+			CSRFToken:     csrfToken(creds.Session.Token),
+			ExpiresAt:     creds.Session.ExpiresAt,
+			IdleExpiresAt: creds.Session.IdleExpiresAt,
 		}
 		server.JSONResponse(w, 200, output)
+		return
+	}
+
+	output := struct {
+		Token                 string    `json:"token"`
+		ExpiresAt             time.Time `json:"expires_at"`
+		IdleExpiresAt         time.Time `json:"idle_expires_at"`
+		AccessToken           string    `json:"access_token"`
+		AccessTokenExpiresAt  time.Time `json:"access_token_expires_at"`
+		RefreshToken          string    `json:"refresh_token"`
+		RefreshTokenExpiresAt time.Time `json:"refresh_token_expires_at"`
+	}{
+		Token:                 creds.Session.Token,
+		ExpiresAt:             creds.Session.ExpiresAt,
+		IdleExpiresAt:         creds.Session.IdleExpiresAt,
+		AccessToken:           creds.AccessToken,
+		AccessTokenExpiresAt:  creds.AccessTokenExpiresAt,
+		RefreshToken:          creds.RefreshToken.Token,
+		RefreshTokenExpiresAt: creds.RefreshToken.ExpiresAt,
 	}
+	server.JSONResponse(w, 200, output)
 }
 
-func (s *Service) Login(ctx context.Context, email, password string) (string, error) {
+// Login checks email and password of a user connecting from client. Unknown
+// emails and wrong passwords fail the same way, and repeated failures lock
+// out the account and the client for a while.
+func (s *Service) Login(ctx context.Context, email, password string, client session.Client) (Credentials, error) {
+	accountKey := emailThrottleKey(email)
+	if err := s.attempt(accountKey, client.IP); err != nil {
+		return Credentials{}, err
+	}
+
 	repo := repository.New(s.db)
 	u := repo.UserWithEmail(ctx, email)
+
+	if !s.checkPassword(ctx, u, password) {
+		return Credentials{}, fmt.Errorf("email or password not match: %w", ErrInvalidLogin)
+	}
+	s.succeeded(accountKey, client.IP)
+
+	return s.completeLogin(ctx, u, client)
+}
+
+// completeLogin finishes a login whose first factor succeeded, asking for
+// the second factor when the user enabled one.
+func (s *Service) completeLogin(ctx context.Context, u *repository.User, client session.Client) (Credentials, error) {
+	if u.TOTPEnabled {
+		challenge, expiresAt, err := s.issueTwoFactorChallenge(u.ID)
+		if err != nil {
+			return Credentials{}, fmt.Errorf("unable to issue two-factor challenge: %w", err)
+		}
+		return Credentials{TwoFactorChallenge: challenge, TwoFactorChallengeExpiresAt: expiresAt}, nil
+	}
+
+	return s.issueCredentials(ctx, u.ID, client)
+}
+
+func (s *Service) issueCredentials(ctx context.Context, userID int, client session.Client) (Credentials, error) {
+	err := s.ensureActive(ctx, userID)
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	sess, err := s.sessions.Create(ctx, userID, client)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("unable to create session: %w", err)
+	}
+
+	accessToken, expiresAt, err := s.issueAccessToken(ctx, userID)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("unable to sign access token: %w", err)
+	}
+
+	rt, err := s.refreshTokens.Create(ctx, userID)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("unable to create refresh token: %w", err)
+	}
+
+	return Credentials{
+		Session:              sess,
+		AccessToken:          accessToken,
+		AccessTokenExpiresAt: expiresAt,
+		RefreshToken:         rt,
+	}, nil
+}
+
+// issueAccessToken signs an access token of the user's current token
+// generation, which RevokeUserAccessTokens moves past.
+func (s *Service) issueAccessToken(ctx context.Context, userID int) (string, time.Time, error) {
+	u := repository.New(s.db).User(ctx, userID)
+	if u == nil {
+		return "", time.Time{}, fmt.Errorf("user with id %d: %w", userID, ErrNotFound)
+	}
+
+	claims := accessClaims{
+		Claims:     s.signer.NewClaims(strconv.Itoa(userID), accessTokenAudience, s.accessTokenTTL),
+		Generation: u.TokenGeneration,
+	}
+	token, err := s.signer.Sign(claims)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return token, time.Unix(claims.ExpiresAt, 0), nil
+}
+
+// accessToken is a verified access token. ImpersonatorID is the admin
+// behind an impersonation token.
+type accessToken struct {
+	UserID         int
+	ImpersonatorID int
+	Generation     int
+}
+
+func (s *Service) verifyAccessToken(token string) (accessToken, error) {
+	var claims accessClaims
+	err := s.signer.Verify(token, accessTokenAudience, &claims)
+	if err != nil {
+		return accessToken{}, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	id, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return accessToken{}, fmt.Errorf("%w: subject %q", ErrInvalidToken, claims.Subject)
+	}
+
+	var impersonatorID int
+	if claims.Actor != nil {
+		impersonatorID, err = strconv.Atoi(claims.Actor.Subject)
+		if err != nil {
+			return accessToken{}, fmt.Errorf("%w: actor %q", ErrInvalidToken, claims.Actor.Subject)
+		}
+	}
+	return accessToken{UserID: id, ImpersonatorID: impersonatorID, Generation: claims.Generation}, nil
+}
+
+// ensureAccessToken checks that the user of t may sign in and that t was not
+// issued before their tokens were last revoked.
+func (s *Service) ensureAccessToken(ctx context.Context, t accessToken) error {
+	u := repository.New(s.db).User(ctx, t.UserID)
 	if u == nil {
-		return "", fmt.Errorf("user with email %s: %w", email, ErrNotFound)
+		return fmt.Errorf("user with id %d: %w", t.UserID, ErrInvalidToken)
+	}
+	if t.Generation != u.TokenGeneration {
+		return fmt.Errorf("%w: revoked", ErrInvalidToken)
+	}
+	if err := checkActive(u, time.Now()); err != nil {
+		return err
+	}
+	if t.ImpersonatorID != 0 {
+		return s.ensureImpersonator(ctx, t.ImpersonatorID)
+	}
+	return nil
+}
+
+// ensureImpersonator checks that the admin behind an impersonation token is
+// still an active admin, so banning or demoting them ends the impersonation
+// right away instead of when the token expires.
+func (s *Service) ensureImpersonator(ctx context.Context, actorID int) error {
+	actor := repository.New(s.db).User(ctx, actorID)
+	if actor == nil {
+		return fmt.Errorf("impersonator with id %d: %w", actorID, ErrInvalidToken)
+	}
+	if err := checkActive(actor, time.Now()); err != nil {
+		return fmt.Errorf("%w: impersonator: %v", ErrInvalidToken, err)
+	}
+	if policy.Role(actor.Role) != policy.RoleAdmin {
+		return fmt.Errorf("%w: impersonator is no longer an admin", ErrInvalidToken)
+	}
+	return nil
+}
+
+func (s *Service) RefreshHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+
+		err := json.NewDecoder(r.Body).Decode(&input)
+		if err != nil {
+			server.ErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		creds, err := s.Refresh(r.Context(), input.RefreshToken)
+		if err != nil {
+			status := http.StatusInternalServerError
+			switch {
+			case errors.Is(err, ErrInvalidToken):
+				status = http.StatusUnauthorized
+			case errors.Is(err, ErrAccountSuspended):
+				status = http.StatusForbidden
+			}
+			server.ErrorResponse(w, status, err)
+			return
+		}
+
+		output := struct {
+			AccessToken           string    `json:"access_token"`
+			AccessTokenExpiresAt  time.Time `json:"access_token_expires_at"`
+			RefreshToken          string    `json:"refresh_token"`
+			RefreshTokenExpiresAt time.Time `json:"refresh_token_expires_at"`
+		}{
+			AccessToken:           creds.AccessToken,
+			AccessTokenExpiresAt:  creds.AccessTokenExpiresAt,
+			RefreshToken:          creds.RefreshToken.Token,
+			RefreshTokenExpiresAt: creds.RefreshToken.ExpiresAt,
+		}
+		server.JSONResponse(w, http.StatusOK, output)
+	}
+}
+
+// Refresh rotates refreshToken and issues a new access token. The returned
+// credentials carry no session.
+func (s *Service) Refresh(ctx context.Context, refreshToken string) (Credentials, error) {
+	rt, err := s.refreshTokens.Rotate(ctx, refreshToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, session.ErrRefreshReused):
+			slog.Warn("refresh token reuse detected, family revoked")
+			return Credentials{}, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+		case errors.Is(err, session.ErrNotFound), errors.Is(err, session.ErrExpired):
+			return Credentials{}, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+		}
+		return Credentials{}, fmt.Errorf("unable to rotate refresh token: %w", err)
+	}
+
+	err = s.ensureActive(ctx, rt.UserID)
+	if err != nil {
+		return Credentials{}, err
 	}
 
-	if bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) != nil {
-		return "", fmt.Errorf("user password not match: %w", ErrInvalidLogin)
+	accessToken, expiresAt, err := s.issueAccessToken(ctx, rt.UserID)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("unable to sign access token: %w", err)
 	}
 
-	token := session.Create(u.ID)
-	return token, nil
+	return Credentials{
+		AccessToken:          accessToken,
+		AccessTokenExpiresAt: expiresAt,
+		RefreshToken:         rt,
+	}, nil
+}
+
+func (s *Service) LogoutHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Clients holding a refresh token may send it to revoke it as well.
+		var input struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		if r.ContentLength != 0 {
+			err := json.NewDecoder(r.Body).Decode(&input)
+			if err != nil {
+				server.ErrorResponse(w, http.StatusBadRequest, err)
+				return
+			}
+		}
+
+		err := s.Logout(r.Context(), TokenFromContext(r.Context()), input.RefreshToken)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, ErrStatelessLogout) {
+				status = http.StatusBadRequest
+			}
+			server.ErrorResponse(w, status, err)
+			return
+		}
+
+		if _, fromCookie := requestToken(r); fromCookie {
+			s.clearSessionCookie(w)
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// Logout ends the session of token. Access tokens cannot be revoked one by
+// one, a client signed in with one logs out by revoking its refresh token
+// and lets the access token run out.
+func (s *Service) Logout(ctx context.Context, token, refreshToken string) error {
+	if jwt.IsJWT(token) {
+		if refreshToken == "" {
+			return ErrStatelessLogout
+		}
+	} else {
+		err := s.sessions.Delete(ctx, token)
+		if err != nil {
+			return fmt.Errorf("unable to revoke session: %w", err)
+		}
+	}
+
+	if refreshToken != "" {
+		err := s.refreshTokens.Delete(ctx, refreshToken)
+		if err != nil {
+			return fmt.Errorf("unable to revoke refresh token: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s *Service) RevokeAllSessionsHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := s.RevokeAllSessions(r.Context(), IDFromContext(r.Context()))
+		if err != nil {
+			server.ErrorResponse(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// RevokeAllSessions signs the user out everywhere, revoking sessions,
+// refresh tokens and the access tokens issued so far.
+func (s *Service) RevokeAllSessions(ctx context.Context, userID int) error {
+	err := repository.New(s.db).RevokeUserAccessTokens(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("unable to revoke access tokens of user %d: %w", userID, err)
+	}
+
+	err = s.sessions.DeleteByUser(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("unable to revoke sessions of user %d: %w", userID, err)
+	}
+
+	err = s.refreshTokens.DeleteByUser(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("unable to revoke refresh tokens of user %d: %w", userID, err)
+	}
+	return nil
 }
 
 func (s *Service) execInTx(ctx context.Context, fn func(*repository.Repository) error) error {
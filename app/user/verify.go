@@ -0,0 +1,164 @@
+package user
+
+import (
+	"app/jwt"
+	"app/mailer"
+	"app/repository"
+	"app/server"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+var ErrAlreadyVerified = errors.New("email already verified")
+
+const (
+	verifyEmailAudience = "verify-email"
+	verifyEmailTTL      = 24 * time.Hour
+)
+
+// verifyEmailClaims bind a verification link to the address it was sent to,
+// so links for a previous address stop working after an email change.
+type verifyEmailClaims struct {
+	jwt.Claims
+	Email string `json:"email"`
+}
+
+// VerifyEmailPageHandler serves the page the emailed verification link
+// opens.
+func (s *Service) VerifyEmailPageHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeConfirmPage(w, confirmPageData{
+			Title:   "Verify your email address",
+			Message: "Confirm that this email address belongs to you.",
+			Button:  "Verify",
+			Done:    "Your email address is verified.",
+			Action:  "/verify-email",
+			Token:   r.URL.Query().Get("token"),
+		})
+	}
+}
+
+func (s *Service) VerifyEmailHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input struct {
+			Token string `json:"token"`
+		}
+
+		err := json.NewDecoder(r.Body).Decode(&input)
+		if err != nil {
+			server.ErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		err = s.VerifyEmail(r.Context(), input.Token)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, ErrInvalidToken) {
+				status = http.StatusBadRequest
+			}
+			server.ErrorResponse(w, status, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func (s *Service) VerifyEmail(ctx context.Context, token string) error {
+	var claims verifyEmailClaims
+	err := s.signer.Verify(token, verifyEmailAudience, &claims)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return fmt.Errorf("%w: subject %q", ErrInvalidToken, claims.Subject)
+	}
+
+	return s.execInTx(ctx, func(r *repository.Repository) error {
+		r.ForUpdate = true
+		u := r.User(ctx, userID)
+		if u == nil || u.Email != claims.Email {
+			return fmt.Errorf("%w: email changed since the link was sent", ErrInvalidToken)
+		}
+		if u.EmailVerifiedAt != nil {
+			return nil
+		}
+		return r.MarkUserEmailVerified(ctx, u.ID, time.Now())
+	})
+}
+
+func (s *Service) ResendVerificationHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := s.ResendVerification(r.Context(), IDFromContext(r.Context()))
+		if writeLocked(w, err) {
+			return
+		}
+		if err != nil {
+			status := http.StatusInternalServerError
+			switch {
+			case errors.Is(err, ErrAlreadyVerified):
+				status = http.StatusConflict
+			case errors.Is(err, ErrNotFound):
+				status = http.StatusNotFound
+			}
+			server.ErrorResponse(w, status, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// ResendVerification sends a new verification link to the user in the
+// background. Like password reset emails, resends are throttled per user.
+func (s *Service) ResendVerification(ctx context.Context, userID int) error {
+	repo := repository.New(s.db)
+	u := repo.User(ctx, userID)
+	if u == nil {
+		return fmt.Errorf("user with id %d: %w", userID, ErrNotFound)
+	}
+	if u.EmailVerifiedAt != nil {
+		return ErrAlreadyVerified
+	}
+
+	err := limitMail(s.mailLimiter, "verify:"+strconv.Itoa(u.ID))
+	if err != nil {
+		return err
+	}
+
+	sendInBackground(ctx, "verification email", func(ctx context.Context) error {
+		return s.sendVerification(ctx, u.ID, u.Name, u.Email)
+	})
+	return nil
+}
+
+func (s *Service) sendVerification(ctx context.Context, userID int, name, email string) error {
+	claims := verifyEmailClaims{
+		Claims: s.signer.NewClaims(strconv.Itoa(userID), verifyEmailAudience, verifyEmailTTL),
+		Email:  email,
+	}
+	token, err := s.signer.Sign(claims)
+	if err != nil {
+		return fmt.Errorf("unable to sign verification token: %w", err)
+	}
+
+	link := s.baseURL + "/verify-email?token=" + url.QueryEscape(token)
+	err = s.mailer.Send(ctx, mailer.Message{
+		To:      email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Hi %s,\n\nPlease confirm your email address by opening the link below. It expires in %s.\n\n%s\n",
+			name, verifyEmailTTL, link),
+	})
+	if err != nil {
+		return fmt.Errorf("unable to send verification email: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package webauthn
+
+import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+var ErrUnsupportedKey = errors.New("unsupported credential key")
+
+// COSE algorithm identifiers offered to authenticators.
+const (
+	AlgES256 = -7
+	AlgEdDSA = -8
+)
+
+// COSE key parameters, RFC 9052 and RFC 9053.
+const (
+	coseKeyType  = 1
+	coseKeyAlg   = 3
+	coseKeyCurve = -1
+	coseKeyX     = -2
+	coseKeyY     = -3
+
+	coseKeyTypeOKP   = 1
+	coseKeyTypeEC2   = 2
+	coseCurveP256    = 1
+	coseCurveEd25519 = 6
+)
+
+// publicKey verifies assertion signatures of a credential.
+type publicKey interface {
+	verify(data, sig []byte) bool
+}
+
+type es256Key struct {
+	key *ecdsa.PublicKey
+}
+
+func (k es256Key) verify(data, sig []byte) bool {
+	sum := sha256.Sum256(data)
+	return ecdsa.VerifyASN1(k.key, sum[:], sig)
+}
+
+type eddsaKey struct {
+	key ed25519.PublicKey
+}
+
+func (k eddsaKey) verify(data, sig []byte) bool {
+	return ed25519.Verify(k.key, data, sig)
+}
+
+// parsePublicKey parses a COSE_Key as stored for a credential.
+func parsePublicKey(data []byte) (publicKey, error) {
+	v, rest, err := decodeCBOR(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("%w: trailing data", ErrUnsupportedKey)
+	}
+
+	m, ok := v.(map[any]any)
+	if !ok {
+		return nil, fmt.Errorf("%w: not a map", ErrUnsupportedKey)
+	}
+	kty, _ := m[int64(coseKeyType)].(int64)
+	alg, _ := m[int64(coseKeyAlg)].(int64)
+	crv, _ := m[int64(coseKeyCurve)].(int64)
+	x, _ := m[int64(coseKeyX)].([]byte)
+
+	switch {
+	case kty == coseKeyTypeEC2 && alg == AlgES256 && crv == coseCurveP256:
+		y, _ := m[int64(coseKeyY)].([]byte)
+		if len(x) != 32 || len(y) != 32 {
+			return nil, fmt.Errorf("%w: bad P-256 coordinates", ErrUnsupportedKey)
+		}
+
+		// crypto/ecdh rejects points that are not on the curve.
+		point := append(append([]byte{4}, x...), y...)
+		if _, err := ecdh.P256().NewPublicKey(point); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrUnsupportedKey, err)
+		}
+		return es256Key{key: &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}}, nil
+	case kty == coseKeyTypeOKP && alg == AlgEdDSA && crv == coseCurveEd25519:
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%w: bad Ed25519 key", ErrUnsupportedKey)
+		}
+		return eddsaKey{key: ed25519.PublicKey(x)}, nil
+	}
+	return nil, fmt.Errorf("%w: kty %d alg %d crv %d", ErrUnsupportedKey, kty, alg, crv)
+}
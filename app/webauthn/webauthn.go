@@ -0,0 +1,277 @@
+// Package webauthn implements the relying party side of WebAuthn
+// registration and authentication for passkeys. Only the "none" attestation
+// format is accepted: the server trusts the key it is given rather than the
+// make of the authenticator holding it.
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+var (
+	ErrMalformed    = errors.New("malformed webauthn response")
+	ErrClientData   = errors.New("client data mismatch")
+	ErrRPID         = errors.New("relying party id mismatch")
+	ErrUserPresence = errors.New("user not present")
+	ErrAttestation  = errors.New("unsupported attestation")
+	ErrSignature    = errors.New("invalid signature")
+	ErrSignCount    = errors.New("sign count did not increase, authenticator may be cloned")
+)
+
+// Authenticator data flags.
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttested     = 0x40
+	flagExtensions   = 0x80
+)
+
+// Bytes is binary data that travels as unpadded base64url in JSON, the
+// encoding WebAuthn uses for binary fields.
+type Bytes []byte
+
+func (b Bytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+func (b *Bytes) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	// Some clients pad the value, accept both.
+	v, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return err
+	}
+	*b = v
+	return nil
+}
+
+type Config struct {
+	// RPID is the domain credentials are scoped to, e.g. "example.com".
+	RPID   string
+	RPName string
+	// Origins are the exact origins, such as "https://example.com", that
+	// ceremonies may come from.
+	Origins []string
+}
+
+type RelyingParty struct {
+	cfg      Config
+	rpIDHash [32]byte
+}
+
+func New(cfg Config) *RelyingParty {
+	return &RelyingParty{cfg: cfg, rpIDHash: sha256.Sum256([]byte(cfg.RPID))}
+}
+
+func (rp *RelyingParty) ID() string {
+	return rp.cfg.RPID
+}
+
+func (rp *RelyingParty) Name() string {
+	return rp.cfg.RPName
+}
+
+// NewChallenge returns a random challenge encoded as unpadded base64url, the
+// form it comes back in within client data.
+func NewChallenge() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Credential is a newly registered credential. PublicKey is the COSE_Key to
+// store and pass back to VerifyAssertion.
+type Credential struct {
+	ID           []byte
+	PublicKey    []byte
+	SignCount    uint32
+	UserVerified bool
+}
+
+// VerifyRegistration checks the response of navigator.credentials.create()
+// to challenge and returns the new credential.
+func (rp *RelyingParty) VerifyRegistration(challenge string, clientDataJSON, attestationObject []byte) (Credential, error) {
+	err := rp.verifyClientData(clientDataJSON, "webauthn.create", challenge)
+	if err != nil {
+		return Credential{}, err
+	}
+
+	v, _, err := decodeCBOR(attestationObject)
+	if err != nil {
+		return Credential{}, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	obj, ok := v.(map[any]any)
+	if !ok {
+		return Credential{}, fmt.Errorf("%w: attestation object is not a map", ErrMalformed)
+	}
+
+	format, _ := obj["fmt"].(string)
+	stmt, _ := obj["attStmt"].(map[any]any)
+	if format != "none" || len(stmt) > 0 {
+		return Credential{}, fmt.Errorf("%w: %q", ErrAttestation, format)
+	}
+
+	rawAuthData, _ := obj["authData"].([]byte)
+	ad, err := rp.parseAuthData(rawAuthData)
+	if err != nil {
+		return Credential{}, err
+	}
+	if ad.flags&flagAttested == 0 {
+		return Credential{}, fmt.Errorf("%w: no attested credential data", ErrMalformed)
+	}
+
+	if _, err := parsePublicKey(ad.publicKey); err != nil {
+		return Credential{}, err
+	}
+
+	return Credential{
+		ID:           ad.credentialID,
+		PublicKey:    ad.publicKey,
+		SignCount:    ad.signCount,
+		UserVerified: ad.flags&flagUserVerified != 0,
+	}, nil
+}
+
+// Assertion is the outcome of a verified authentication.
+type Assertion struct {
+	SignCount    uint32
+	UserVerified bool
+}
+
+// VerifyAssertion checks the response of navigator.credentials.get() to
+// challenge against a stored credential. The returned sign count must be
+// stored for the next check.
+func (rp *RelyingParty) VerifyAssertion(challenge string, publicKey []byte, storedSignCount uint32,
+	clientDataJSON, authenticatorData, signature []byte) (Assertion, error) {
+	err := rp.verifyClientData(clientDataJSON, "webauthn.get", challenge)
+	if err != nil {
+		return Assertion{}, err
+	}
+
+	ad, err := rp.parseAuthData(authenticatorData)
+	if err != nil {
+		return Assertion{}, err
+	}
+
+	key, err := parsePublicKey(publicKey)
+	if err != nil {
+		return Assertion{}, err
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(slices.Clip(authenticatorData), clientDataHash[:]...)
+	if !key.verify(signed, signature) {
+		return Assertion{}, ErrSignature
+	}
+
+	// Authenticators without a counter always report zero.
+	if (ad.signCount != 0 || storedSignCount != 0) && ad.signCount <= storedSignCount {
+		return Assertion{}, ErrSignCount
+	}
+
+	return Assertion{
+		SignCount:    ad.signCount,
+		UserVerified: ad.flags&flagUserVerified != 0,
+	}, nil
+}
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+func (rp *RelyingParty) verifyClientData(data []byte, typ, challenge string) error {
+	var cd clientData
+	err := json.Unmarshal(data, &cd)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+
+	if cd.Type != typ {
+		return fmt.Errorf("%w: type %q", ErrClientData, cd.Type)
+	}
+	if subtle.ConstantTimeCompare([]byte(cd.Challenge), []byte(challenge)) != 1 {
+		return fmt.Errorf("%w: challenge", ErrClientData)
+	}
+	if !slices.Contains(rp.cfg.Origins, cd.Origin) {
+		return fmt.Errorf("%w: origin %q", ErrClientData, cd.Origin)
+	}
+	return nil
+}
+
+type authData struct {
+	flags        byte
+	signCount    uint32
+	credentialID []byte
+	publicKey    []byte
+}
+
+// parseAuthData parses authenticator data and checks that it is meant for
+// this relying party and the user was present.
+func (rp *RelyingParty) parseAuthData(data []byte) (authData, error) {
+	if len(data) < 37 {
+		return authData{}, fmt.Errorf("%w: authenticator data too short", ErrMalformed)
+	}
+	if !bytes.Equal(data[:32], rp.rpIDHash[:]) {
+		return authData{}, ErrRPID
+	}
+
+	ad := authData{
+		flags:     data[32],
+		signCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	if ad.flags&flagUserPresent == 0 {
+		return authData{}, ErrUserPresence
+	}
+
+	rest := data[37:]
+	if ad.flags&flagAttested != 0 {
+		// AAGUID, then the length prefixed credential ID and its key.
+		if len(rest) < 18 {
+			return authData{}, fmt.Errorf("%w: attested data too short", ErrMalformed)
+		}
+		n := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if n == 0 || len(rest) < n {
+			return authData{}, fmt.Errorf("%w: bad credential id", ErrMalformed)
+		}
+		ad.credentialID = append([]byte(nil), rest[:n]...)
+		rest = rest[n:]
+
+		_, after, err := decodeCBOR(rest)
+		if err != nil {
+			return authData{}, fmt.Errorf("%w: credential key: %v", ErrMalformed, err)
+		}
+		ad.publicKey = append([]byte(nil), rest[:len(rest)-len(after)]...)
+		rest = after
+	}
+
+	if ad.flags&flagExtensions != 0 {
+		_, after, err := decodeCBOR(rest)
+		if err != nil {
+			return authData{}, fmt.Errorf("%w: extensions: %v", ErrMalformed, err)
+		}
+		rest = after
+	}
+	if len(rest) > 0 {
+		return authData{}, fmt.Errorf("%w: trailing authenticator data", ErrMalformed)
+	}
+	return ad, nil
+}
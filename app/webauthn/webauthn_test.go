@@ -0,0 +1,317 @@
+package webauthn
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testRPID   = "example.com"
+	testOrigin = "https://example.com"
+)
+
+func newTestRP() *RelyingParty {
+	return New(Config{RPID: testRPID, RPName: "Example", Origins: []string{testOrigin}})
+}
+
+// authenticator is a software authenticator. Its fields shape the next
+// response, so tests can make it misbehave.
+type authenticator struct {
+	t         *testing.T
+	alg       int
+	ecKey     *ecdsa.PrivateKey
+	edKey     ed25519.PrivateKey
+	id        []byte
+	rpID      string
+	origin    string
+	flags     byte
+	signCount uint32
+}
+
+func newAuthenticator(t *testing.T, alg int) *authenticator {
+	a := &authenticator{
+		t:      t,
+		alg:    alg,
+		id:     make([]byte, 16),
+		rpID:   testRPID,
+		origin: testOrigin,
+		flags:  flagUserPresent | flagUserVerified,
+	}
+	_, err := rand.Read(a.id)
+	require.NoError(t, err)
+
+	switch alg {
+	case AlgES256:
+		a.ecKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case AlgEdDSA:
+		_, a.edKey, err = ed25519.GenerateKey(rand.Reader)
+	}
+	require.NoError(t, err)
+	return a
+}
+
+func (a *authenticator) coseKey() []byte {
+	if a.alg == AlgEdDSA {
+		return encodeCBOR(map[int]any{
+			coseKeyType:  coseKeyTypeOKP,
+			coseKeyAlg:   AlgEdDSA,
+			coseKeyCurve: coseCurveEd25519,
+			coseKeyX:     []byte(a.edKey.Public().(ed25519.PublicKey)),
+		})
+	}
+
+	pub, err := a.ecKey.PublicKey.ECDH()
+	require.NoError(a.t, err)
+	point := pub.Bytes()
+	return encodeCBOR(map[int]any{
+		coseKeyType:  coseKeyTypeEC2,
+		coseKeyAlg:   AlgES256,
+		coseKeyCurve: coseCurveP256,
+		coseKeyX:     point[1:33],
+		coseKeyY:     point[33:],
+	})
+}
+
+func (a *authenticator) clientData(typ, challenge string) []byte {
+	data, err := json.Marshal(clientData{Type: typ, Challenge: challenge, Origin: a.origin})
+	require.NoError(a.t, err)
+	return data
+}
+
+func (a *authenticator) authData(attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	flags := a.flags
+	if attested {
+		flags |= flagAttested
+	}
+
+	data := append(rpIDHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	if attested {
+		data = append(data, make([]byte, 16)...)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(a.id)))
+		data = append(data, a.id...)
+		data = append(data, a.coseKey()...)
+	}
+	return data
+}
+
+// create answers navigator.credentials.create() with "none" attestation.
+func (a *authenticator) create(challenge string) (clientDataJSON, attestationObject []byte) {
+	attestationObject = encodeCBOR(map[string]any{
+		"fmt":      "none",
+		"attStmt":  map[string]any{},
+		"authData": a.authData(true),
+	})
+	return a.clientData("webauthn.create", challenge), attestationObject
+}
+
+// get answers navigator.credentials.get(), counting the signature.
+func (a *authenticator) get(challenge string) (clientDataJSON, authenticatorData, signature []byte) {
+	if a.signCount > 0 {
+		a.signCount++
+	}
+	clientDataJSON = a.clientData("webauthn.get", challenge)
+	authenticatorData = a.authData(false)
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte(nil), authenticatorData...), clientDataHash[:]...)
+	if a.alg == AlgEdDSA {
+		return clientDataJSON, authenticatorData, ed25519.Sign(a.edKey, signed)
+	}
+
+	sum := sha256.Sum256(signed)
+	signature, err := ecdsa.SignASN1(rand.Reader, a.ecKey, sum[:])
+	require.NoError(a.t, err)
+	return clientDataJSON, authenticatorData, signature
+}
+
+// encodeCBOR encodes the few types the authenticator needs.
+func encodeCBOR(v any) []byte {
+	switch v := v.(type) {
+	case int:
+		if v < 0 {
+			return cborHead(1, uint64(-1-v))
+		}
+		return cborHead(0, uint64(v))
+	case []byte:
+		return append(cborHead(2, uint64(len(v))), v...)
+	case string:
+		return append(cborHead(3, uint64(len(v))), v...)
+	case map[int]any:
+		data := cborHead(5, uint64(len(v)))
+		for k, item := range v {
+			data = append(data, encodeCBOR(k)...)
+			data = append(data, encodeCBOR(item)...)
+		}
+		return data
+	case map[string]any:
+		data := cborHead(5, uint64(len(v)))
+		for k, item := range v {
+			data = append(data, encodeCBOR(k)...)
+			data = append(data, encodeCBOR(item)...)
+		}
+		return data
+	}
+	panic("unsupported cbor type")
+}
+
+func cborHead(major byte, arg uint64) []byte {
+	switch {
+	case arg < 24:
+		return []byte{major<<5 | byte(arg)}
+	case arg <= 0xff:
+		return []byte{major<<5 | 24, byte(arg)}
+	default:
+		return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(arg))
+	}
+}
+
+func newTestChallenge(t *testing.T) string {
+	challenge, err := NewChallenge()
+	require.NoError(t, err)
+	return challenge
+}
+
+// register runs a registration that is expected to succeed.
+func register(t *testing.T, rp *RelyingParty, a *authenticator) Credential {
+	challenge := newTestChallenge(t)
+	clientDataJSON, attestationObject := a.create(challenge)
+	cred, err := rp.VerifyRegistration(challenge, clientDataJSON, attestationObject)
+	require.NoError(t, err)
+	return cred
+}
+
+var algorithms = []struct {
+	name string
+	alg  int
+}{
+	{"ES256", AlgES256},
+	{"Ed25519", AlgEdDSA},
+}
+
+func TestRegisterAndSignIn(t *testing.T) {
+	for _, tt := range algorithms {
+		t.Run(tt.name, func(t *testing.T) {
+			rp := newTestRP()
+			a := newAuthenticator(t, tt.alg)
+			a.signCount = 1
+
+			cred := register(t, rp, a)
+			require.Equal(t, a.id, cred.ID)
+			require.Equal(t, uint32(1), cred.SignCount)
+			require.True(t, cred.UserVerified)
+
+			signCount := cred.SignCount
+			for range 2 {
+				challenge := newTestChallenge(t)
+				clientDataJSON, authData, sig := a.get(challenge)
+				assertion, err := rp.VerifyAssertion(challenge, cred.PublicKey, signCount, clientDataJSON, authData, sig)
+				require.NoError(t, err)
+				require.Greater(t, assertion.SignCount, signCount)
+				require.True(t, assertion.UserVerified)
+				signCount = assertion.SignCount
+			}
+		})
+	}
+}
+
+func TestSignInWithoutCounter(t *testing.T) {
+	rp := newTestRP()
+	a := newAuthenticator(t, AlgEdDSA)
+	a.flags = flagUserPresent
+	cred := register(t, rp, a)
+
+	challenge := newTestChallenge(t)
+	clientDataJSON, authData, sig := a.get(challenge)
+	assertion, err := rp.VerifyAssertion(challenge, cred.PublicKey, 0, clientDataJSON, authData, sig)
+	require.NoError(t, err)
+	require.Zero(t, assertion.SignCount)
+	require.False(t, assertion.UserVerified)
+}
+
+func TestRegistrationRejected(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(a *authenticator, challenge *string)
+		err    error
+	}{
+		{"wrong rp id", func(a *authenticator, _ *string) { a.rpID = "evil.example" }, ErrRPID},
+		{"wrong origin", func(a *authenticator, _ *string) { a.origin = "https://evil.example" }, ErrClientData},
+		{"wrong challenge", func(_ *authenticator, c *string) { *c = "other" }, ErrClientData},
+		{"user not present", func(a *authenticator, _ *string) { a.flags = flagUserVerified }, ErrUserPresence},
+	}
+	for _, alg := range algorithms {
+		for _, tt := range tests {
+			t.Run(alg.name+"/"+tt.name, func(t *testing.T) {
+				rp := newTestRP()
+				a := newAuthenticator(t, alg.alg)
+
+				challenge := newTestChallenge(t)
+				answered := challenge
+				tt.modify(a, &answered)
+
+				clientDataJSON, attestationObject := a.create(answered)
+				_, err := rp.VerifyRegistration(challenge, clientDataJSON, attestationObject)
+				require.ErrorIs(t, err, tt.err)
+			})
+		}
+	}
+}
+
+func TestAssertionRejected(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(a *authenticator, challenge *string)
+		err    error
+	}{
+		{"wrong rp id", func(a *authenticator, _ *string) { a.rpID = "evil.example" }, ErrRPID},
+		{"wrong origin", func(a *authenticator, _ *string) { a.origin = "https://evil.example" }, ErrClientData},
+		{"wrong challenge", func(_ *authenticator, c *string) { *c = "other" }, ErrClientData},
+		{"user not present", func(a *authenticator, _ *string) { a.flags = flagUserVerified }, ErrUserPresence},
+		{"sign count regression", func(a *authenticator, _ *string) { a.signCount = 2 }, ErrSignCount},
+	}
+	for _, alg := range algorithms {
+		for _, tt := range tests {
+			t.Run(alg.name+"/"+tt.name, func(t *testing.T) {
+				rp := newTestRP()
+				a := newAuthenticator(t, alg.alg)
+				a.signCount = 5
+				cred := register(t, rp, a)
+
+				challenge := newTestChallenge(t)
+				answered := challenge
+				tt.modify(a, &answered)
+
+				clientDataJSON, authData, sig := a.get(answered)
+				_, err := rp.VerifyAssertion(challenge, cred.PublicKey, cred.SignCount, clientDataJSON, authData, sig)
+				require.ErrorIs(t, err, tt.err)
+			})
+		}
+	}
+}
+
+func TestAssertionWrongKey(t *testing.T) {
+	rp := newTestRP()
+	a := newAuthenticator(t, AlgES256)
+	cred := register(t, rp, newAuthenticator(t, AlgES256))
+
+	challenge := newTestChallenge(t)
+	clientDataJSON, authData, sig := a.get(challenge)
+	_, err := rp.VerifyAssertion(challenge, cred.PublicKey, 0, clientDataJSON, authData, sig)
+	require.ErrorIs(t, err, ErrSignature)
+
+	// A signature over other data is rejected too.
+	cred = register(t, rp, a)
+	authData[len(authData)-1] ^= 1
+	_, err = rp.VerifyAssertion(challenge, cred.PublicKey, 0, clientDataJSON, authData, sig)
+	require.ErrorIs(t, err, ErrSignature)
+}
@@ -3,6 +3,17 @@ CREATE TABLE user (
     name VARCHAR(255) NOT NULL,
     email VARCHAR(255) NOT NULL UNIQUE,
     password_hash TEXT NOT NULL,
+    role VARCHAR(16) NOT NULL DEFAULT 'author',
+    totp_secret VARCHAR(64) NULL,
+    totp_enabled BOOLEAN NOT NULL DEFAULT FALSE,
+    totp_last_step BIGINT NOT NULL DEFAULT 0,
+    email_verified_at TIMESTAMP NULL,
+    bio VARCHAR(1000) NOT NULL DEFAULT '',
+    avatar_url VARCHAR(2048) NOT NULL DEFAULT '',
+    website VARCHAR(2048) NOT NULL DEFAULT '',
+    status VARCHAR(16) NOT NULL DEFAULT 'active',
+    suspended_until TIMESTAMP NULL,
+    token_generation INT UNSIGNED NOT NULL DEFAULT 0,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
 );
@@ -10,9 +21,13 @@ CREATE TABLE post (
     id INT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
     title VARCHAR(255) NOT NULL,
     content TEXT NOT NULL,
+    slug VARCHAR(255) COLLATE utf8mb4_bin NOT NULL UNIQUE,
     author_id INT UNSIGNED NOT NULL,
+    status VARCHAR(16) NOT NULL DEFAULT 'published',
+    published_at TIMESTAMP NULL,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    INDEX (status, published_at),
     FOREIGN KEY (author_id)
         REFERENCES user(id)
         ON DELETE CASCADE
@@ -20,10 +35,155 @@ CREATE TABLE post (
 CREATE TABLE comment (
     id INT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
     post_id INT UNSIGNED NOT NULL,
+    author_id INT UNSIGNED NULL,
     author_name VARCHAR(255) NOT NULL,
     content TEXT NOT NULL,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (post_id)
+        REFERENCES post(id)
+        ON DELETE CASCADE,
+    FOREIGN KEY (author_id)
+        REFERENCES user(id)
+        ON DELETE SET NULL
+);
+CREATE TABLE session (
+    token_hash CHAR(64) NOT NULL PRIMARY KEY,
+    id CHAR(32) NOT NULL UNIQUE,
+    user_id INT UNSIGNED NOT NULL,
+    ip VARCHAR(45) NOT NULL DEFAULT '',
+    user_agent VARCHAR(512) NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_seen_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    idle_expires_at TIMESTAMP NOT NULL,
+    INDEX (expires_at),
+    INDEX (idle_expires_at),
+    FOREIGN KEY (user_id)
+        REFERENCES user(id)
+        ON DELETE CASCADE
+);
+CREATE TABLE refresh_token (
+    token_hash CHAR(64) NOT NULL PRIMARY KEY,
+    family_id CHAR(32) NOT NULL,
+    user_id INT UNSIGNED NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP NULL,
+    INDEX (family_id),
+    INDEX (expires_at),
+    FOREIGN KEY (user_id)
+        REFERENCES user(id)
+        ON DELETE CASCADE
+);
+CREATE TABLE personal_access_token (
+    id INT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    user_id INT UNSIGNED NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    scopes VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NULL,
+    last_used_at TIMESTAMP NULL,
+    FOREIGN KEY (user_id)
+        REFERENCES user(id)
+        ON DELETE CASCADE
+);
+CREATE TABLE user_identity (
+    id INT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    issuer VARCHAR(255) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    user_id INT UNSIGNED NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (issuer, subject),
+    FOREIGN KEY (user_id)
+        REFERENCES user(id)
+        ON DELETE CASCADE
+);
+CREATE TABLE recovery_code (
+    id INT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    user_id INT UNSIGNED NOT NULL,
+    code_hash CHAR(64) NOT NULL,
+    used_at TIMESTAMP NULL,
+    INDEX (user_id, code_hash),
+    FOREIGN KEY (user_id)
+        REFERENCES user(id)
+        ON DELETE CASCADE
+);
+CREATE TABLE user_token (
+    token_hash CHAR(64) NOT NULL PRIMARY KEY,
+    user_id INT UNSIGNED NOT NULL,
+    purpose VARCHAR(32) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP NULL,
+    INDEX (user_id, purpose),
+    FOREIGN KEY (user_id)
+        REFERENCES user(id)
+        ON DELETE CASCADE
+);
+CREATE TABLE audit_log (
+    id INT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    actor_id INT UNSIGNED NULL,
+    action VARCHAR(64) NOT NULL,
+    target_user_id INT UNSIGNED NULL,
+    detail VARCHAR(1000) NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX (target_user_id),
+    FOREIGN KEY (actor_id)
+        REFERENCES user(id)
+        ON DELETE SET NULL,
+    FOREIGN KEY (target_user_id)
+        REFERENCES user(id)
+        ON DELETE SET NULL
+);
+CREATE TABLE invite (
+    id INT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    code_hash CHAR(64) NOT NULL UNIQUE,
+    role VARCHAR(16) NOT NULL,
+    max_uses INT UNSIGNED NOT NULL DEFAULT 1,
+    uses INT UNSIGNED NOT NULL DEFAULT 0,
+    expires_at TIMESTAMP NULL,
+    created_by INT UNSIGNED NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (created_by)
+        REFERENCES user(id)
+        ON DELETE SET NULL
+);
+CREATE TABLE webauthn_credential (
+    id INT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    user_id INT UNSIGNED NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    credential_id VARBINARY(255) NOT NULL UNIQUE,
+    public_key VARBINARY(1024) NOT NULL,
+    sign_count INT UNSIGNED NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_used_at TIMESTAMP NULL,
+    FOREIGN KEY (user_id)
+        REFERENCES user(id)
+        ON DELETE CASCADE
+);
+CREATE TABLE webauthn_challenge (
+    id CHAR(32) NOT NULL PRIMARY KEY,
+    expires_at TIMESTAMP NOT NULL,
+    INDEX (expires_at)
+);
+CREATE TABLE post_revision (
+    id INT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    post_id INT UNSIGNED NOT NULL,
+    rev INT UNSIGNED NOT NULL,
+    title VARCHAR(255) NOT NULL,
+    content TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (post_id, rev),
     FOREIGN KEY (post_id)
         REFERENCES post(id)
         ON DELETE CASCADE
-);
\ No newline at end of file
+);
+CREATE TABLE post_slug (
+    slug VARCHAR(255) COLLATE utf8mb4_bin NOT NULL PRIMARY KEY,
+    post_id INT UNSIGNED NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (post_id)
+        REFERENCES post(id)
+        ON DELETE CASCADE
+);